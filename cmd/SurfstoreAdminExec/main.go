@@ -0,0 +1,175 @@
+package main
+
+import (
+	"cse224/proj5/pkg/raft"
+	"cse224/proj5/pkg/surfstore"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Usage strings
+const USAGE_STRING = "SurfstoreAdminExec <add|remove|promote|transfer|status> -f config_file.txt [-i serverId]"
+
+const CONFIG_USAGE = "Path to config file with the addresses of all Raft nodes, including the one being added"
+const ID_USAGE = "Id of the server to change, its address and role are read from the config file, not used by status"
+const DEBUG_USAGE = "Output log statements"
+
+// Exit codes
+const EX_USAGE int = 64
+const EX_UNAVAILABLE int = 69
+
+func main() {
+	if len(os.Args) < 2 {
+		usage(nil)
+	}
+	command := os.Args[1]
+
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	flags.Usage = func() { usage(flags) }
+	debug := flags.Bool("d", false, DEBUG_USAGE)
+	configFile := flags.String("f", "", "(required) "+CONFIG_USAGE)
+	serverId := flags.Int64("i", -1, "(required) "+ID_USAGE)
+	flags.Parse(os.Args[2:])
+
+	if *configFile == "" || (*serverId < 0 && command != "status") {
+		usage(flags)
+	}
+	configuration := surfstore.LoadRaftConfiguration(*configFile)
+	addrs := surfstore.LoadRaftConfigFile(*configFile)
+	if *serverId >= int64(len(addrs)) {
+		fmt.Fprintf(os.Stderr, "Server %d is not in %s\n", *serverId, *configFile)
+		os.Exit(EX_USAGE)
+	}
+
+	// Disable log outputs if debug flag is missing
+	if !(*debug) {
+		log.SetFlags(0)
+		log.SetOutput(ioutil.Discard)
+	}
+
+	rpcClient := surfstore.NewSurfstoreRPCClient(addrs, "", 0)
+	if command == "status" {
+		printStatus(&rpcClient, configuration)
+		return
+	}
+
+	var members []*raft.ClusterMember
+	var err error
+	switch command {
+	case "add":
+		member := configuration.Members[*serverId]
+		err = rpcClient.AddServer(member.ServerId, member.Addr, member.Learner, &members)
+	case "remove":
+		err = rpcClient.RemoveServer(*serverId, &members)
+	case "promote":
+		err = rpcClient.PromoteLearner(*serverId, &members)
+	case "transfer":
+		var succ bool
+		if err = rpcClient.TransferLeadership(*serverId, &succ); err == nil && !succ {
+			err = fmt.Errorf("server %d did not take over in time", *serverId)
+		}
+	default:
+		usage(flags)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, command, "failed:", err)
+		os.Exit(EX_UNAVAILABLE)
+	}
+
+	if command == "transfer" {
+		fmt.Printf("Server %d is now the leader\n", *serverId)
+		return
+	}
+
+	fmt.Println("Cluster members:")
+	for _, member := range members {
+		if member.Learner {
+			fmt.Printf("  %d: %s %s\n", member.ServerId, member.Addr, surfstore.LEARNER_ROLE)
+		} else {
+			fmt.Printf("  %d: %s\n", member.ServerId, member.Addr)
+		}
+	}
+}
+
+// Asks every server in configuration for its status and prints them as a
+// table. MATCH and LAST ACK are the leader's view of each server's log and
+// of when it last answered the leader, REACHABLE whether it answered us.
+func printStatus(rpcClient *surfstore.RPCClient, configuration *raft.Configuration) {
+	statuses := make([]*raft.ClusterStatus, len(configuration.Members))
+	var leader *raft.ClusterStatus
+	for idx, member := range configuration.Members {
+		if err := rpcClient.GetClusterStatus(member.Addr, &statuses[idx]); err != nil {
+			log.Printf("Server %d at %s: %v", member.ServerId, member.Addr, err)
+			continue
+		}
+		if statuses[idx].Role == raft.Role_LEADER && (leader == nil || statuses[idx].Term > leader.Term) {
+			leader = statuses[idx]
+		}
+	}
+
+	peers := make(map[int64]*raft.PeerStatus)
+	if leader != nil {
+		fmt.Printf("Leader: %d, term %d\n", leader.ServerId, leader.Term)
+		for _, peer := range leader.Peers {
+			peers[peer.ServerId] = peer
+		}
+	} else {
+		fmt.Println("Leader: none found")
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "ID\tADDR\tROLE\tTERM\tCOMMIT\tAPPLIED\tMATCH\tLAST ACK\tREACHABLE")
+	for idx, member := range configuration.Members {
+		status := statuses[idx]
+		if status == nil {
+			fmt.Fprintf(table, "%d\t%s\t-\t-\t-\t-\t%s\t%s\tno\n",
+				member.ServerId, member.Addr, matchIndex(leader, peers, member.ServerId), lastAck(peers, member.ServerId))
+			continue
+		}
+		fmt.Fprintf(table, "%d\t%s\t%s\t%d\t%d\t%d\t%s\t%s\tyes\n",
+			member.ServerId, member.Addr, strings.ToLower(status.Role.String()), status.Term, status.CommitIndex, status.LastApplied,
+			matchIndex(leader, peers, member.ServerId), lastAck(peers, member.ServerId))
+	}
+	table.Flush()
+
+	if leader == nil {
+		os.Exit(EX_UNAVAILABLE)
+	}
+}
+
+// The leader matches its own log up to its last entry
+func matchIndex(leader *raft.ClusterStatus, peers map[int64]*raft.PeerStatus, serverId int64) string {
+	if leader != nil && leader.ServerId == serverId {
+		return strconv.FormatInt(leader.LastLogIndex, 10)
+	}
+	if peer, ok := peers[serverId]; ok {
+		return strconv.FormatInt(peer.MatchIndex, 10)
+	}
+	return "-"
+}
+
+func lastAck(peers map[int64]*raft.PeerStatus, serverId int64) string {
+	if peer, ok := peers[serverId]; ok && peer.LastAckMs >= 0 {
+		return strconv.FormatInt(peer.LastAckMs, 10) + "ms ago"
+	}
+	return "-"
+}
+
+func usage(flags *flag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "Usage of %s:\n", USAGE_STRING)
+	fmt.Fprintf(os.Stderr, "  add: Add a server to the cluster, as a learner if marked as one in the config file\n")
+	fmt.Fprintf(os.Stderr, "  remove: Remove a server from the cluster\n")
+	fmt.Fprintf(os.Stderr, "  promote: Make a learner that has caught up a voter\n")
+	fmt.Fprintf(os.Stderr, "  transfer: Hand leadership over to a server, e.g. before restarting the leader\n")
+	fmt.Fprintf(os.Stderr, "  status: Show the role, term and log progress of every server\n")
+	if flags != nil {
+		flags.PrintDefaults()
+	}
+	os.Exit(EX_USAGE)
+}
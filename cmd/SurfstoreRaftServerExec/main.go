@@ -12,8 +12,14 @@ func main() {
 	configFile := flag.String("f", "", "(required) Config file, absolute path")
 	blockStoreAddr := flag.String("b", "", "(required) BlockStore address")
 	debug := flag.Bool("d", false, "Output log statements")
+	manual := flag.Bool("manual", false, "Disable leader election, leaders are only set through SetLeader")
+	dataDir := flag.String("data-dir", "", "Directory for the raft write-ahead log, state is lost on restart if empty")
+	snapshotThreshold := flag.Int64("snapshot-threshold", 0, "Applied log entries kept before compacting into a snapshot (default 1000)")
+	leaseReads := flag.Bool("lease-reads", false, "Serve reads locally while holding a leader lease, should be set on every server")
+	join := flag.Bool("join", false, "Start outside the cluster and wait to be added with AddServer")
 	flag.Parse()
 
+	configuration := surfstore.LoadRaftConfiguration(*configFile)
 	addrs := surfstore.LoadRaftConfigFile(*configFile)
 
 	// Disable log outputs if debug flag is missing
@@ -22,13 +28,22 @@ func main() {
 		log.SetOutput(ioutil.Discard)
 	}
 
-	log.Fatal(startServer(*serverId, addrs, *blockStoreAddr))
+	opts := surfstore.RaftServerOptions{
+		ManualElection:    *manual,
+		DataDir:           *dataDir,
+		SnapshotThreshold: *snapshotThreshold,
+		LeaseReads:        *leaseReads,
+		Configuration:     configuration,
+		Join:              *join,
+	}
+
+	log.Fatal(startServer(*serverId, addrs, *blockStoreAddr, opts))
 }
 
-func startServer(id int64, addrs []string, blockStoreAddr string) error {
-	raftServer, err := surfstore.NewRaftServer(id, addrs, blockStoreAddr)
+func startServer(id int64, addrs []string, blockStoreAddr string, opts surfstore.RaftServerOptions) error {
+	raftServer, err := surfstore.NewRaftServer(id, addrs, blockStoreAddr, opts)
 	if err != nil {
-		log.Fatal("Error creating servers")
+		log.Fatal("Error creating servers: ", err)
 	}
 
 	return surfstore.ServeRaftServer(raftServer)
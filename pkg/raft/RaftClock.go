@@ -0,0 +1,257 @@
+package raft
+
+import (
+	"container/heap"
+	context "context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// The time source of a server, which also runs its background work.
+// Servers normally run on the real clock, where timer callbacks and Go run
+// on goroutines of their own. The simulation harness substitutes a
+// SimulatedClock that only moves when it is advanced, so timeouts, leases
+// and elections follow virtual time, and runs them as events one at a time.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) ClockTimer
+	// Calls fn once d has passed, like time.AfterFunc
+	AfterFunc(d time.Duration, fn func()) ClockTimer
+	// Runs fn on its own, like a go statement
+	Go(fn func())
+	// Like context.WithTimeout, but a simulated deadline ends the context
+	// with context.Canceled
+	WithTimeout(parent context.Context, d time.Duration) (context.Context, context.CancelFunc)
+}
+
+type ClockTimer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+type realClock struct{}
+
+type realTimer struct{ *time.Timer }
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) NewTimer(d time.Duration) ClockTimer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) AfterFunc(d time.Duration, fn func()) ClockTimer {
+	return realTimer{time.AfterFunc(d, fn)}
+}
+
+func (realClock) Go(fn func()) {
+	go fn()
+}
+
+func (realClock) WithTimeout(parent context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, d)
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+// A Clock whose time only moves when Advance or Step is called. Its timers
+// form a single event queue: they fire one at a time in deadline order as
+// the clock passes them, on the goroutine moving it, and timers due at the
+// same time fire in an order drawn from the seed. Go queues fn as a timer
+// due right away, so as long as only that goroutine uses the clock, the
+// seed decides the order of everything that runs.
+type SimulatedClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	rand   *rand.Rand
+	timers simTimers
+}
+
+type simTimer struct {
+	clock *SimulatedClock
+	when  time.Time
+	order int64
+	// Position in the clock's timers, -1 while stopped or fired
+	index int
+	c     chan time.Time
+	fn    func()
+}
+
+// The pending timers, a heap ordered by when they fire
+type simTimers []*simTimer
+
+func NewSimulatedClock(start time.Time, seed int64) *SimulatedClock {
+	return &SimulatedClock{
+		now:  start,
+		rand: rand.New(rand.NewSource(seed)),
+	}
+}
+
+func (c *SimulatedClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *SimulatedClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+func (c *SimulatedClock) NewTimer(d time.Duration) ClockTimer {
+	return c.schedule(d, nil)
+}
+
+// Calls fn on the goroutine that moves the clock past d
+func (c *SimulatedClock) AfterFunc(d time.Duration, fn func()) ClockTimer {
+	return c.schedule(d, fn)
+}
+
+// Queues fn as an event due right away. Like every event it runs on the
+// goroutine moving the clock, among the others due at the same time in the
+// order the seed decides.
+func (c *SimulatedClock) Go(fn func()) {
+	c.schedule(0, fn)
+}
+
+func (c *SimulatedClock) WithTimeout(parent context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	timer := c.schedule(d, cancel)
+	return ctx, func() {
+		timer.Stop()
+		cancel()
+	}
+}
+
+// Moves the clock forward by d, firing every timer that falls due on the way
+func (c *SimulatedClock) Advance(d time.Duration) {
+	end := c.Now().Add(d)
+	for c.Step(end) {
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.now.Before(end) {
+		c.now = end
+	}
+}
+
+// Fires the next timer due by end, moving the clock up to its deadline.
+// Reports false, without moving the clock, if no timer is due by then.
+func (c *SimulatedClock) Step(end time.Time) bool {
+	c.mutex.Lock()
+	if len(c.timers) == 0 || c.timers[0].when.After(end) {
+		c.mutex.Unlock()
+		return false
+	}
+	next := heap.Pop(&c.timers).(*simTimer)
+	if next.when.After(c.now) {
+		c.now = next.when
+	}
+	now := c.now
+	c.mutex.Unlock()
+
+	// callbacks may take locks of their own, and use the clock
+	next.fire(now)
+	return true
+}
+
+func (c *SimulatedClock) schedule(d time.Duration, fn func()) *simTimer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	timer := &simTimer{
+		clock: c,
+		when:  c.now.Add(d),
+		order: c.rand.Int63(),
+		fn:    fn,
+	}
+	if fn == nil {
+		timer.c = make(chan time.Time, 1)
+	}
+	heap.Push(&c.timers, timer)
+	return timer
+}
+
+func (h simTimers) Len() int {
+	return len(h)
+}
+
+func (h simTimers) Less(i, j int) bool {
+	if h[i].when.Equal(h[j].when) {
+		return h[i].order < h[j].order
+	}
+	return h[i].when.Before(h[j].when)
+}
+
+func (h simTimers) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *simTimers) Push(x interface{}) {
+	timer := x.(*simTimer)
+	timer.index = len(*h)
+	*h = append(*h, timer)
+}
+
+func (h *simTimers) Pop() interface{} {
+	old := *h
+	timer := old[len(old)-1]
+	old[len(old)-1] = nil
+	timer.index = -1
+	*h = old[:len(old)-1]
+	return timer
+}
+
+// Like a time.Timer, a value that wasn't received yet is dropped
+func (t *simTimer) fire(now time.Time) {
+	if t.fn != nil {
+		t.fn()
+		return
+	}
+	select {
+	case t.c <- now:
+	default:
+	}
+}
+
+func (t *simTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *simTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+
+	if t.index < 0 {
+		return false
+	}
+	heap.Remove(&t.clock.timers, t.index)
+	return true
+}
+
+func (t *simTimer) Reset(d time.Duration) bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+
+	active := t.index >= 0
+	t.when = t.clock.now.Add(d)
+	t.order = t.clock.rand.Int63()
+	if active {
+		heap.Fix(&t.clock.timers, t.index)
+	} else {
+		heap.Push(&t.clock.timers, t)
+	}
+	return active
+}
@@ -0,0 +1,139 @@
+package raft
+
+import (
+	context "context"
+	"errors"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+)
+
+var errTransportClosed = errors.New("Transport is closed")
+
+// The Transport servers use by default. It keeps one long-lived connection
+// per address, dialled on first use, so RPCs between peers don't pay for
+// connection setup. gRPC reconnects on its own, with backoff, when a peer
+// restarts.
+type GRPCTransport struct {
+	mutex       sync.Mutex
+	conns       map[string]*grpc.ClientConn
+	clients     map[string]RaftClient
+	closed      bool
+	dialOptions []grpc.DialOption
+}
+
+// dialOptions are added to those of every connection
+func NewGRPCTransport(dialOptions ...grpc.DialOption) *GRPCTransport {
+	return &GRPCTransport{
+		conns:       make(map[string]*grpc.ClientConn),
+		clients:     make(map[string]RaftClient),
+		dialOptions: dialOptions,
+	}
+}
+
+func (t *GRPCTransport) AppendEntries(ctx context.Context, addr string, input *AppendEntryInput) (*AppendEntryOutput, error) {
+	client, err := t.client(addr)
+	if err != nil {
+		return nil, err
+	}
+	return client.AppendEntries(ctx, input)
+}
+
+func (t *GRPCTransport) RequestVote(ctx context.Context, addr string, input *RequestVoteInput) (*RequestVoteOutput, error) {
+	client, err := t.client(addr)
+	if err != nil {
+		return nil, err
+	}
+	return client.RequestVote(ctx, input)
+}
+
+func (t *GRPCTransport) InstallSnapshot(ctx context.Context, addr string, input *InstallSnapshotInput) (*InstallSnapshotOutput, error) {
+	client, err := t.client(addr)
+	if err != nil {
+		return nil, err
+	}
+	return client.InstallSnapshot(ctx, input)
+}
+
+func (t *GRPCTransport) TimeoutNow(ctx context.Context, addr string, input *TimeoutNowInput) (*Success, error) {
+	client, err := t.client(addr)
+	if err != nil {
+		return nil, err
+	}
+	return client.TimeoutNow(ctx, input)
+}
+
+func (t *GRPCTransport) client(addr string) (RaftClient, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.closed {
+		return nil, errTransportClosed
+	}
+	if client, ok := t.clients[addr]; ok {
+		return client, nil
+	}
+
+	dialOptions := append([]grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		// retry quickly, a peer that restarts should rejoin well within an
+		// election timeout
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff: backoff.Config{
+				BaseDelay:  HEARTBEAT_INTERVAL,
+				Multiplier: 1.6,
+				Jitter:     0.2,
+				MaxDelay:   ELECTION_TIMEOUT_MIN,
+			},
+			MinConnectTimeout: RAFT_RPC_TIMEOUT,
+		}),
+		// notice a peer that vanished without closing the connection
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                PEER_KEEPALIVE_TIME,
+			Timeout:             PEER_KEEPALIVE_TIMEOUT,
+			PermitWithoutStream: true,
+		}),
+	}, t.dialOptions...)
+	conn, err := grpc.Dial(addr, dialOptions...)
+	if err != nil {
+		return nil, err
+	}
+	t.conns[addr] = conn
+	t.clients[addr] = NewRaftClient(conn)
+	return t.clients[addr], nil
+}
+
+// Closes the connections to every address not in members, once a server
+// leaves the cluster
+func (t *GRPCTransport) Retain(members []*ClusterMember) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	keep := make(map[string]bool, len(members))
+	for _, member := range members {
+		keep[member.Addr] = true
+	}
+	for addr, conn := range t.conns {
+		if !keep[addr] {
+			conn.Close()
+			delete(t.conns, addr)
+			delete(t.clients, addr)
+		}
+	}
+}
+
+// Closes every connection, later RPCs fail
+func (t *GRPCTransport) Close() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, conn := range t.conns {
+		conn.Close()
+	}
+	t.conns = make(map[string]*grpc.ClientConn)
+	t.clients = make(map[string]RaftClient)
+	t.closed = true
+}
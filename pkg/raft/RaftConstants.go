@@ -0,0 +1,66 @@
+package raft
+
+import (
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Unavailable, so clients know to try another server
+var ERR_SERVER_CRASHED = status.Error(codes.Unavailable, "Server is crashed.")
+
+// Unavailable, a leader cut off from the majority may have been replaced
+var ERR_NO_QUORUM = status.Error(codes.Unavailable, "Could not reach a majority of servers")
+
+// A new configuration change must wait for the previous one to commit
+var ERR_CONFIG_CHANGE_PENDING = status.Error(codes.Aborted, "A configuration change is in progress")
+
+// Only one leadership transfer runs at a time
+var ERR_TRANSFER_IN_PROGRESS = status.Error(codes.Aborted, "A leadership transfer is in progress")
+
+// Learners are only promoted once they hold every committed entry
+var ERR_LEARNER_BEHIND = status.Error(codes.Aborted, "The learner has not caught up with the log yet")
+
+// Returned with a NotLeader detail naming the leader, see notLeaderError
+var ERR_NOT_LEADER = fmt.Errorf("Server is not the leader")
+
+// Followers that hear nothing from a leader for a random duration in
+// [ELECTION_TIMEOUT_MIN, ELECTION_TIMEOUT_MAX) start a new election.
+const ELECTION_TIMEOUT_MIN = 400 * time.Millisecond
+const ELECTION_TIMEOUT_MAX = 800 * time.Millisecond
+
+// How often a leader sends AppendEntries to its followers, well below ELECTION_TIMEOUT_MIN
+const HEARTBEAT_INTERVAL = 100 * time.Millisecond
+
+// The most entries sent in one AppendEntries, and how many AppendEntries a
+// leader keeps in flight to each follower without waiting for replies
+const MAX_ENTRIES_PER_APPEND = 512
+const MAX_INFLIGHT_APPENDS = 4
+
+// The most proposed commands appended to the log, and written to disk, at once
+const MAX_APPEND_BATCH = 256
+
+// Applied entries kept in the log before it is compacted into a snapshot
+const SNAPSHOT_THRESHOLD int64 = 1000
+
+// How long a single RequestVote or AppendEntries call may take
+const RAFT_RPC_TIMEOUT = 200 * time.Millisecond
+
+// How often a connection to a peer that has been idle is pinged, and how
+// long the ping may go unanswered before the connection is dropped
+const PEER_KEEPALIVE_TIME = 10 * time.Second
+const PEER_KEEPALIVE_TIMEOUT = 2 * time.Second
+
+// How long after a majority acknowledged a heartbeat the leader may serve
+// reads locally. Kept well below ELECTION_TIMEOUT_MIN so the lease runs out
+// before any follower could vote for a new leader, despite clock drift.
+const LEASE_DURATION = 300 * time.Millisecond
+
+// How long a leadership transfer may take before the leader gives up and
+// accepts writes again (§3.10)
+const TRANSFER_TIMEOUT = ELECTION_TIMEOUT_MIN
+
+// The longest a read waits to confirm leadership with a majority
+const READ_INDEX_TIMEOUT = 500 * time.Millisecond
@@ -0,0 +1,210 @@
+package raft
+
+import (
+	context "context"
+	"time"
+)
+
+// Called by the election timer. Every time it fires without having been
+// reset by a leader or a granted vote, a new election is started.
+func (s *Server) electionTimeout() {
+	if s.isStopped() {
+		return
+	}
+	s.isLeaderMutex.Lock()
+	s.electionTimer.Reset(s.randomElectionTimeout())
+	campaign := !s.isLeader && !s.crashed()
+	s.isLeaderMutex.Unlock()
+	if campaign {
+		s.startElection(false)
+	}
+}
+
+// Must be called with isLeaderMutex held, which guards rand
+func (s *Server) randomElectionTimeout() time.Duration {
+	spread := int64(ELECTION_TIMEOUT_MAX - ELECTION_TIMEOUT_MIN)
+	return ELECTION_TIMEOUT_MIN + time.Duration(s.rand.Int63n(spread))
+}
+
+// Postpones the next election, called whenever we hear from a valid leader
+// or grant a vote. Must be called with isLeaderMutex held.
+func (s *Server) resetElectionTimer() {
+	if s.electionTimer != nil {
+		s.electionTimer.Reset(s.randomElectionTimeout())
+	}
+}
+
+// Becomes a candidate for the next term and asks every other server for its
+// vote. leadershipTransfer is set when the leader asked us to take over.
+// Returns once the requests are sent, the replies are counted as they come
+// in.
+func (s *Server) startElection(leadershipTransfer bool) {
+	// A server that was cut off would otherwise bump its term on every
+	// timeout and depose a healthy leader once it is back (§9.6), so it
+	// first checks that it could win without touching any term
+	if leadershipTransfer {
+		s.campaign(true)
+	} else {
+		s.preVote()
+	}
+}
+
+func (s *Server) campaign(leadershipTransfer bool) {
+	s.isLeaderMutex.Lock()
+	defer s.isLeaderMutex.Unlock()
+	// learners and servers outside the configuration never campaign, so a
+	// removed server doesn't disrupt the cluster
+	if s.isLeader || s.crashed() || !s.isVoter(s.serverId) {
+		return
+	}
+	s.term += 1
+	s.votedFor = s.serverId
+	s.leaderId = -1
+	s.persistState()
+	electionTerm := s.term
+	lastLogIndex, lastLogTerm := s.lastLogIndexAndTerm()
+	quorumSize := s.quorumSize()
+
+	input := &RequestVoteInput{
+		Term:               electionTerm,
+		CandidateId:        s.serverId,
+		LastLogIndex:       lastLogIndex,
+		LastLogTerm:        lastLogTerm,
+		LeadershipTransfer: leadershipTransfer,
+	}
+
+	// we always vote for ourselves
+	votes := 1
+	if votes >= quorumSize {
+		s.becomeLeader()
+		return
+	}
+	for _, peer := range s.voterPeers() {
+		s.requestVote(peer.Addr, input, func(output *RequestVoteOutput) {
+			if output == nil {
+				return
+			}
+			s.isLeaderMutex.Lock()
+			defer s.isLeaderMutex.Unlock()
+			s.updateTerm(output.Term)
+			if s.term != electionTerm || s.isLeader || !output.VoteGranted {
+				return
+			}
+			votes++
+			if votes >= quorumSize {
+				s.becomeLeader()
+			}
+		})
+	}
+}
+
+// Asks every voter whether it would vote for us in the next term, and
+// campaigns once a majority would
+func (s *Server) preVote() {
+	s.isLeaderMutex.RLock()
+	defer s.isLeaderMutex.RUnlock()
+	if s.isLeader || s.crashed() || !s.isVoter(s.serverId) {
+		return
+	}
+	term := s.term
+	lastLogIndex, lastLogTerm := s.lastLogIndexAndTerm()
+	input := &RequestVoteInput{
+		Term:         term + 1,
+		CandidateId:  s.serverId,
+		LastLogIndex: lastLogIndex,
+		LastLogTerm:  lastLogTerm,
+		PreVote:      true,
+	}
+	quorumSize := s.quorumSize()
+
+	votes := 1
+	if votes >= quorumSize {
+		s.clock.Go(func() { s.campaign(false) })
+		return
+	}
+	for _, peer := range s.voterPeers() {
+		s.requestVote(peer.Addr, input, func(output *RequestVoteOutput) {
+			if output == nil || !output.VoteGranted {
+				return
+			}
+			s.isLeaderMutex.Lock()
+			votes++
+			// only the vote that makes the majority campaigns, and only
+			// if nothing happened meanwhile
+			won := votes == quorumSize && s.term == term && !s.isLeader
+			s.isLeaderMutex.Unlock()
+			if won {
+				s.campaign(false)
+			}
+		})
+	}
+}
+
+// Sends a single RequestVote to addr on its own, handing the reply to
+// handle, or nil if the server could not be reached
+func (s *Server) requestVote(addr string, input *RequestVoteInput, handle func(output *RequestVoteOutput)) {
+	s.clock.Go(func() {
+		ctx, cancel := s.clock.WithTimeout(context.Background(), RAFT_RPC_TIMEOUT)
+		defer cancel()
+		output, err := s.transport.RequestVote(ctx, addr, input)
+		if err != nil {
+			output = nil
+		}
+		handle(output)
+	})
+}
+
+// Must be called with isLeaderMutex held. Sends the first heartbeat right away.
+func (s *Server) becomeLeader() {
+	s.isLeader = true
+	s.transferringLeadership = false
+	s.leaderId = s.serverId
+	for _, member := range s.configuration.Members {
+		s.nextIndex[member.Addr] = s.lastLogIndex() + 1
+		s.matchIndex[member.Addr] = -1
+		// acks from an earlier term don't count towards this one's lease
+		delete(s.lastAck, member.Addr)
+	}
+
+	// Entries from earlier terms can only be committed together with one
+	// from our own term (§5.4.2), so if any are outstanding append a no-op
+	// that the next heartbeat commits. Until then reads could miss them.
+	if s.lastLogIndex() > s.commitIndex {
+		s.log = append(s.log, &LogEntry{Term: s.term, Type: EntryType_NOOP})
+		s.persistLog(s.lastLogIndex())
+	}
+	s.termStartIndex = s.lastLogIndex()
+
+	// replies to replicators of an earlier term are ignored
+	s.replicators = make(map[string]*replicator)
+	s.startReplicators()
+	s.triggerHeartbeat()
+}
+
+// Moves to a newer term seen in any request or response, reverting to
+// follower. Must be called with isLeaderMutex held.
+func (s *Server) updateTerm(term int64) {
+	if term > s.term {
+		s.leaderId = -1
+		if s.isLeader {
+			s.failPendingCommits()
+		}
+		s.term = term
+		s.votedFor = -1
+		s.isLeader = false // revert to follower stage
+		s.persistState()
+	}
+}
+
+func (s *Server) lastLogIndexAndTerm() (int64, int64) {
+	lastLogIndex := s.lastLogIndex()
+	return lastLogIndex, s.termAt(lastLogIndex)
+}
+
+// Reports whether a log ending at lastLogIndex and lastLogTerm is at least
+// as up-to-date as ours (§5.4.1). Must be called with isLeaderMutex held.
+func (s *Server) logUpToDate(lastLogIndex, lastLogTerm int64) bool {
+	ourLastIndex, ourLastTerm := s.lastLogIndexAndTerm()
+	return lastLogTerm > ourLastTerm ||
+		(lastLogTerm == ourLastTerm && lastLogIndex >= ourLastIndex)
+}
@@ -0,0 +1,127 @@
+package raft
+
+import (
+	context "context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/status"
+)
+
+// Disturbs the RPCs a server sends to one address: each is held back for
+// Delay plus a random part of Jitter, which reorders pipelined requests, and
+// then lost with probability DropRate, taking as long as a timeout would
+type NetworkFault struct {
+	DropRate float64
+	Delay    time.Duration
+	Jitter   time.Duration
+}
+
+// Network faults injected by tests. They apply to the RPCs this server sends
+// to its peers, an RPC and its reply count as one message, so a partition
+// that only blocks traffic in one direction needs a fault on one side only.
+type networkFaults struct {
+	mutex  sync.Mutex
+	faults map[string]NetworkFault
+	rand   *rand.Rand
+	clock  Clock
+}
+
+func newNetworkFaults(clock Clock) *networkFaults {
+	return &networkFaults{
+		faults: make(map[string]NetworkFault),
+		rand:   rand.New(rand.NewSource(clock.Now().UnixNano())),
+		clock:  clock,
+	}
+}
+
+// Decides the fate of one message to addr: how long it is held back and
+// whether it is lost
+func (f *networkFaults) roll(addr string) (time.Duration, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	fault, ok := f.faults[addr]
+	if !ok {
+		return 0, false
+	}
+	delay := fault.Delay
+	if fault.Jitter > 0 {
+		delay += time.Duration(f.rand.Int63n(int64(fault.Jitter)))
+	}
+	return delay, f.rand.Float64() < fault.DropRate
+}
+
+// Holds back a message to addr as long as its fault says, failing once ctx
+// ends if the message is lost
+func (f *networkFaults) apply(ctx context.Context, addr string) error {
+	delay, dropped := f.roll(addr)
+	if delay > 0 {
+		select {
+		case <-f.clock.After(delay):
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		}
+	}
+	if dropped {
+		// a lost message is only noticed once the caller gives up on it
+		<-ctx.Done()
+		return status.FromContextError(ctx.Err()).Err()
+	}
+	return nil
+}
+
+// Applies the faults to the RPCs sent over the embedded Transport, whichever
+// it is
+type faultyTransport struct {
+	Transport
+	faults *networkFaults
+}
+
+func (t *faultyTransport) AppendEntries(ctx context.Context, addr string, input *AppendEntryInput) (*AppendEntryOutput, error) {
+	if err := t.faults.apply(ctx, addr); err != nil {
+		return nil, err
+	}
+	return t.Transport.AppendEntries(ctx, addr, input)
+}
+
+func (t *faultyTransport) RequestVote(ctx context.Context, addr string, input *RequestVoteInput) (*RequestVoteOutput, error) {
+	if err := t.faults.apply(ctx, addr); err != nil {
+		return nil, err
+	}
+	return t.Transport.RequestVote(ctx, addr, input)
+}
+
+func (t *faultyTransport) InstallSnapshot(ctx context.Context, addr string, input *InstallSnapshotInput) (*InstallSnapshotOutput, error) {
+	if err := t.faults.apply(ctx, addr); err != nil {
+		return nil, err
+	}
+	return t.Transport.InstallSnapshot(ctx, addr, input)
+}
+
+func (t *faultyTransport) TimeoutNow(ctx context.Context, addr string, input *TimeoutNowInput) (*Success, error) {
+	if err := t.faults.apply(ctx, addr); err != nil {
+		return nil, err
+	}
+	return t.Transport.TimeoutNow(ctx, addr, input)
+}
+
+// Replaces the fault on RPCs to addr, a zero fault clears it
+func (s *Server) SetNetworkFault(addr string, fault NetworkFault) {
+	s.faults.mutex.Lock()
+	defer s.faults.mutex.Unlock()
+
+	if fault.DropRate <= 0 && fault.Delay <= 0 && fault.Jitter <= 0 {
+		delete(s.faults.faults, addr)
+	} else {
+		s.faults.faults[addr] = fault
+	}
+}
+
+func (s *Server) ClearNetworkFaults() {
+	s.faults.mutex.Lock()
+	defer s.faults.mutex.Unlock()
+
+	s.faults.faults = make(map[string]NetworkFault)
+}
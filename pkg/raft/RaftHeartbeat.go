@@ -0,0 +1,49 @@
+package raft
+
+// Called by the heartbeat timer every HEARTBEAT_INTERVAL. While this server
+// is an uncrashed leader it sends AppendEntries to every follower, so they
+// learn about commits and don't start elections, without waiting for the
+// replies. Followers that couldn't be reached are retried from here.
+func (s *Server) heartbeat() {
+	if s.isStopped() {
+		return
+	}
+	s.isLeaderMutex.Lock()
+	s.heartbeatTimer.Reset(HEARTBEAT_INTERVAL)
+	if !s.isLeader || s.crashed() {
+		s.isLeaderMutex.Unlock()
+		return
+	}
+	term := s.term
+	peers := s.peers()
+	for _, peer := range peers {
+		if replicator, ok := s.replicators[peer.Addr]; ok {
+			replicator.backingOff = false
+		}
+	}
+	s.isLeaderMutex.Unlock()
+
+	for _, peer := range peers {
+		addr := peer.Addr
+		s.clock.Go(func() {
+			s.replicateTo(addr, term)
+		})
+	}
+}
+
+// Makes the heartbeat timer fire immediately. Must be called with
+// isLeaderMutex held.
+func (s *Server) triggerHeartbeat() {
+	if s.heartbeatTimer != nil {
+		s.heartbeatTimer.Reset(0)
+	}
+}
+
+func (s *Server) isStopped() bool {
+	select {
+	case <-s.stopped:
+		return true
+	default:
+		return false
+	}
+}
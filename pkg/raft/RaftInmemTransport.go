@@ -0,0 +1,135 @@
+package raft
+
+import (
+	context "context"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Servers in one process that reach each other by calling each other's
+// handlers directly, for embedding, tests and benchmarks. Every message is
+// copied, so servers never share the inputs and outputs of an RPC.
+type InmemNetwork struct {
+	mutex   sync.RWMutex
+	servers map[string]RaftInterface
+	filter  func(ctx context.Context, from, to string) error
+}
+
+func NewInmemNetwork() *InmemNetwork {
+	return &InmemNetwork{servers: make(map[string]RaftInterface)}
+}
+
+// Makes server reachable at addr
+func (n *InmemNetwork) Register(addr string, server RaftInterface) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.servers[addr] = server
+}
+
+// Runs filter before every message, which is lost with the error filter
+// returns, if any. Messages that get through are delivered right away on
+// the sender's goroutine.
+func (n *InmemNetwork) SetFilter(filter func(ctx context.Context, from, to string) error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.filter = filter
+}
+
+// The Transport of the server at addr
+func (n *InmemNetwork) Transport(addr string) *InmemTransport {
+	return &InmemTransport{network: n, from: addr}
+}
+
+// Sends the RPCs of one server over an InmemNetwork
+type InmemTransport struct {
+	network *InmemNetwork
+	from    string
+
+	mutex  sync.RWMutex
+	closed bool
+}
+
+func (t *InmemTransport) AppendEntries(ctx context.Context, addr string, input *AppendEntryInput) (*AppendEntryOutput, error) {
+	var output *AppendEntryOutput
+	err := t.send(ctx, addr, func(server RaftInterface) (err error) {
+		output, err = server.AppendEntries(ctx, proto.Clone(input).(*AppendEntryInput))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return proto.Clone(output).(*AppendEntryOutput), nil
+}
+
+func (t *InmemTransport) RequestVote(ctx context.Context, addr string, input *RequestVoteInput) (*RequestVoteOutput, error) {
+	var output *RequestVoteOutput
+	err := t.send(ctx, addr, func(server RaftInterface) (err error) {
+		output, err = server.RequestVote(ctx, proto.Clone(input).(*RequestVoteInput))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return proto.Clone(output).(*RequestVoteOutput), nil
+}
+
+func (t *InmemTransport) InstallSnapshot(ctx context.Context, addr string, input *InstallSnapshotInput) (*InstallSnapshotOutput, error) {
+	var output *InstallSnapshotOutput
+	err := t.send(ctx, addr, func(server RaftInterface) (err error) {
+		output, err = server.InstallSnapshot(ctx, proto.Clone(input).(*InstallSnapshotInput))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return proto.Clone(output).(*InstallSnapshotOutput), nil
+}
+
+func (t *InmemTransport) TimeoutNow(ctx context.Context, addr string, input *TimeoutNowInput) (*Success, error) {
+	var output *Success
+	err := t.send(ctx, addr, func(server RaftInterface) (err error) {
+		output, err = server.TimeoutNow(ctx, proto.Clone(input).(*TimeoutNowInput))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return proto.Clone(output).(*Success), nil
+}
+
+// Nothing is kept per peer
+func (t *InmemTransport) Retain(members []*ClusterMember) {}
+
+func (t *InmemTransport) Close() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.closed = true
+}
+
+// Runs call against the server at addr, once the network's filter let the
+// message through
+func (t *InmemTransport) send(ctx context.Context, addr string, call func(server RaftInterface) error) error {
+	t.mutex.RLock()
+	closed := t.closed
+	t.mutex.RUnlock()
+	if closed {
+		return errTransportClosed
+	}
+
+	t.network.mutex.RLock()
+	server, ok := t.network.servers[addr]
+	filter := t.network.filter
+	t.network.mutex.RUnlock()
+	if !ok {
+		return status.Errorf(codes.Unavailable, "No server at %s", addr)
+	}
+	if filter != nil {
+		if err := filter(ctx, t.from, addr); err != nil {
+			return err
+		}
+	}
+	return call(server)
+}
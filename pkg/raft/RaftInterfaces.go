@@ -0,0 +1,40 @@
+package raft
+
+import (
+	context "context"
+)
+
+// The state machine the log is replicated to. A server only calls it from
+// its applier, one call at a time and without its own state locked, so it
+// doesn't need to lock against itself, only against readers outside of Raft.
+type FSM interface {
+	// Applies a committed command, exactly once and in log order on every
+	// server. On the leader the result is what Propose returns.
+	Apply(command []byte) interface{}
+	// Serializes everything applied so far
+	Snapshot() ([]byte, error)
+	// Replaces the state with one Snapshot returned, on any server
+	Restore(snapshot []byte) error
+}
+
+// The RPCs servers send each other
+type RaftInterface interface {
+	AppendEntries(ctx context.Context, input *AppendEntryInput) (*AppendEntryOutput, error)
+	RequestVote(ctx context.Context, input *RequestVoteInput) (*RequestVoteOutput, error)
+	InstallSnapshot(ctx context.Context, input *InstallSnapshotInput) (*InstallSnapshotOutput, error)
+	TimeoutNow(ctx context.Context, input *TimeoutNowInput) (*Success, error)
+}
+
+// How a server sends RPCs to the other servers, named by their addresses.
+// The consensus code only reaches its peers through a Transport, so it runs
+// the same over gRPC, in memory, or over anything else that implements it.
+type Transport interface {
+	AppendEntries(ctx context.Context, addr string, input *AppendEntryInput) (*AppendEntryOutput, error)
+	RequestVote(ctx context.Context, addr string, input *RequestVoteInput) (*RequestVoteOutput, error)
+	InstallSnapshot(ctx context.Context, addr string, input *InstallSnapshotInput) (*InstallSnapshotOutput, error)
+	TimeoutNow(ctx context.Context, addr string, input *TimeoutNowInput) (*Success, error)
+	// Lets go of whatever is kept for servers that are not in members
+	Retain(members []*ClusterMember)
+	// Releases everything, later RPCs fail
+	Close()
+}
@@ -0,0 +1,247 @@
+package raft
+
+import (
+	context "context"
+
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Membership changes one server at a time (§4.1). A configuration entry
+// takes effect on each server as soon as it is in its log, committed or not,
+// and the leader only starts a new change once the previous one committed.
+
+func configurationFromAddrs(ips []string) *Configuration {
+	members := make([]*ClusterMember, 0, len(ips))
+	for idx, addr := range ips {
+		members = append(members, &ClusterMember{ServerId: int64(idx), Addr: addr})
+	}
+	return &Configuration{Members: members}
+}
+
+// Returns the configuration in effect at idx and the index of the entry
+// that set it, -1 for the one we started with. Must be called with
+// isLeaderMutex held.
+func (s *Server) configurationAt(idx int64) (*Configuration, int64) {
+	for ; idx > s.snapshotIndex; idx-- {
+		if entry := s.entryAt(idx); entry.Type == EntryType_CONFIGURATION {
+			return entry.Configuration, idx
+		}
+	}
+	if s.snapshot.Configuration != nil {
+		return s.snapshot.Configuration, s.snapshotIndex
+	}
+	return s.initialConfiguration, -1
+}
+
+// Switches to the latest configuration in the log, called whenever entries
+// are added or removed. Must be called with isLeaderMutex held.
+func (s *Server) refreshConfiguration() {
+	s.configuration, s.configIndex = s.configurationAt(s.lastLogIndex())
+	for _, member := range s.configuration.Members {
+		if _, ok := s.matchIndex[member.Addr]; !ok {
+			s.nextIndex[member.Addr] = s.lastLogIndex() + 1
+			s.matchIndex[member.Addr] = -1
+		}
+	}
+	s.startReplicators()
+	s.transport.Retain(s.configuration.Members)
+}
+
+// The members other than us, learners included. Must be called with
+// isLeaderMutex held.
+func (s *Server) peers() []*ClusterMember {
+	peers := make([]*ClusterMember, 0, len(s.configuration.Members))
+	for _, member := range s.configuration.Members {
+		if member.ServerId != s.serverId {
+			peers = append(peers, member)
+		}
+	}
+	return peers
+}
+
+// The members other than us that vote and count towards commits. Must be
+// called with isLeaderMutex held.
+func (s *Server) voterPeers() []*ClusterMember {
+	voters := make([]*ClusterMember, 0, len(s.configuration.Members))
+	for _, member := range s.peers() {
+		if !member.Learner {
+			voters = append(voters, member)
+		}
+	}
+	return voters
+}
+
+// The members other than us that only receive the log. Must be called with
+// isLeaderMutex held.
+func (s *Server) learnerPeers() []*ClusterMember {
+	learners := make([]*ClusterMember, 0)
+	for _, member := range s.peers() {
+		if member.Learner {
+			learners = append(learners, member)
+		}
+	}
+	return learners
+}
+
+// Must be called with isLeaderMutex held
+func (s *Server) isVoter(id int64) bool {
+	for _, member := range s.configuration.Members {
+		if member.ServerId == id {
+			return !member.Learner
+		}
+	}
+	return false
+}
+
+// The number of voters that make up a majority. Must be called with
+// isLeaderMutex held.
+func (s *Server) quorumSize() int {
+	voters := 0
+	for _, member := range s.configuration.Members {
+		if !member.Learner {
+			voters++
+		}
+	}
+	return voters/2 + 1
+}
+
+// Our own vote or copy of the log only counts while we are a voter. Must
+// be called with isLeaderMutex held.
+func (s *Server) selfCount() int {
+	if s.isVoter(s.serverId) {
+		return 1
+	}
+	return 0
+}
+
+// Must be called with isLeaderMutex held
+func (s *Server) addrOf(id int64) string {
+	for _, member := range s.configuration.Members {
+		if member.ServerId == id {
+			return member.Addr
+		}
+	}
+	if id >= 0 && id < int64(len(s.ipList)) {
+		return s.ipList[id]
+	}
+	return ""
+}
+
+// Adds member as a voter, or as a learner if member.Learner is set
+func (s *Server) AddServer(ctx context.Context, member *ClusterMember) (*Configuration, error) {
+	return s.changeConfiguration(ctx, func(configuration *Configuration) (bool, error) {
+		for _, existing := range configuration.Members {
+			if existing.ServerId == member.ServerId {
+				return false, nil
+			}
+		}
+		configuration.Members = append(configuration.Members, &ClusterMember{
+			ServerId: member.ServerId,
+			Addr:     member.Addr,
+			Learner:  member.Learner,
+		})
+		return true, nil
+	})
+}
+
+func (s *Server) RemoveServer(ctx context.Context, member *ClusterMember) (*Configuration, error) {
+	return s.changeConfiguration(ctx, func(configuration *Configuration) (bool, error) {
+		for idx, existing := range configuration.Members {
+			if existing.ServerId == member.ServerId {
+				configuration.Members = append(configuration.Members[:idx], configuration.Members[idx+1:]...)
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+}
+
+// Turns a learner into a voter once it holds every committed entry, so
+// promoting it can't leave the new majority without the latest commits
+func (s *Server) PromoteLearner(ctx context.Context, member *ClusterMember) (*Configuration, error) {
+	return s.changeConfiguration(ctx, func(configuration *Configuration) (bool, error) {
+		for _, existing := range configuration.Members {
+			if existing.ServerId != member.ServerId || !existing.Learner {
+				continue
+			}
+			if s.matchIndex[existing.Addr] < s.commitIndex {
+				return false, ERR_LEARNER_BEHIND
+			}
+			existing.Learner = false
+			return true, nil
+		}
+		return false, nil
+	})
+}
+
+// Appends the configuration produced by change and waits for it to commit,
+// or for ctx to end. change edits a copy of the current configuration and
+// reports whether it differs, if not the current one is returned straight
+// away. It is called with isLeaderMutex held. Like new proposals, changes
+// are refused while we hand leadership over.
+func (s *Server) changeConfiguration(ctx context.Context, change func(configuration *Configuration) (bool, error)) (*Configuration, error) {
+
+	if s.crashed() {
+		return nil, ERR_SERVER_CRASHED
+	}
+
+	s.isLeaderMutex.Lock()
+	if !s.isLeader || s.transferringLeadership {
+		defer s.isLeaderMutex.Unlock()
+		return nil, s.notLeaderError()
+	}
+
+	// until an entry of our term commits we may not know the latest
+	// committed configuration (§4.1 and the fix in the dissertation errata)
+	if s.configIndex > s.commitIndex || s.termStartIndex > s.commitIndex {
+		s.isLeaderMutex.Unlock()
+		return nil, ERR_CONFIG_CHANGE_PENDING
+	}
+
+	configuration := proto.Clone(s.configuration).(*Configuration)
+	changed, err := change(configuration)
+	if err != nil {
+		s.isLeaderMutex.Unlock()
+		return nil, err
+	}
+	if !changed {
+		s.isLeaderMutex.Unlock()
+		return configuration, nil
+	}
+
+	s.log = append(s.log, &LogEntry{
+		Term:          s.term,
+		Type:          EntryType_CONFIGURATION,
+		Configuration: configuration,
+	})
+	targetIdx := s.lastLogIndex()
+	s.persistLog(targetIdx)
+	s.refreshConfiguration()
+	committed := make(chan *ProposalResult, 1)
+	s.pendingCommits[targetIdx] = committed
+	s.notifyReplicators()
+	s.advanceCommitIndex()
+	s.isLeaderMutex.Unlock()
+
+	select {
+	case result := <-committed:
+		if result.Err != nil {
+			return nil, result.Err
+		}
+		return configuration, nil
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+// Called once the configuration at configIndex is applied. A leader that
+// isn't a voter in it hands over by stepping down, so the remaining members
+// elect a new leader among themselves. Must be called with isLeaderMutex held.
+func (s *Server) configurationCommitted() {
+	if s.isLeader && s.lastApplied >= s.configIndex && !s.isVoter(s.serverId) {
+		s.isLeader = false
+		s.leaderId = -1
+		s.failPendingCommits()
+	}
+}
@@ -0,0 +1,110 @@
+package raft
+
+import (
+	context "context"
+	"sort"
+	"time"
+
+	"google.golang.org/grpc/status"
+)
+
+// Waits until the FSM reflects every command committed before the read
+// arrived (§6.4):
+// 1. Record the commit index as the read index, but no earlier than the
+// start of our term, as until then we may not know what previous leaders
+// committed
+// 2. Confirm we are still the leader with one round of heartbeats to a majority
+// 3. Wait until the read index has been applied
+// Fails with ERR_NO_QUORUM if that takes longer than READ_INDEX_TIMEOUT, or
+// with ctx's error if the caller gives up first.
+func (s *Server) readIndex(ctx context.Context) error {
+	timeout := s.clock.NewTimer(READ_INDEX_TIMEOUT)
+	defer timeout.Stop()
+
+	s.isLeaderMutex.RLock()
+	if !s.isLeader {
+		defer s.isLeaderMutex.RUnlock()
+		return s.notLeaderError()
+	}
+	term := s.term
+	readIndex := s.commitIndex
+	if readIndex < s.termStartIndex {
+		readIndex = s.termStartIndex
+	}
+	s.isLeaderMutex.RUnlock()
+
+	confirmed := false
+	for {
+		if !confirmed {
+			confirmed, _ = s.heartbeatRound(term)
+		}
+
+		s.isLeaderMutex.RLock()
+		if !s.isLeader || s.term != term {
+			defer s.isLeaderMutex.RUnlock()
+			return s.notLeaderError()
+		}
+		applied := s.fsmIndex >= readIndex
+		s.isLeaderMutex.RUnlock()
+		if confirmed && applied {
+			return nil
+		}
+
+		// the read index commits with the next heartbeat that reaches a majority
+		if confirmed {
+			s.isLeaderMutex.Lock()
+			s.triggerHeartbeat()
+			s.isLeaderMutex.Unlock()
+		}
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-timeout.C():
+			return ERR_NO_QUORUM
+		case <-s.clock.After(HEARTBEAT_INTERVAL / 10):
+		}
+	}
+}
+
+// Reports whether we could serve a read locally: lease reads are enabled,
+// we hold the lease and everything up to the start of our term is applied
+func (s *Server) leaseRead() bool {
+	s.isLeaderMutex.RLock()
+	defer s.isLeaderMutex.RUnlock()
+	return s.leaseReads && s.isLeader && !s.transferringLeadership && s.leaseValid() &&
+		s.fsmIndex >= s.commitIndex && s.fsmIndex >= s.termStartIndex
+}
+
+// The lease starts when we sent the AppendEntries that the last member of
+// some majority acknowledged. Must be called with isLeaderMutex held.
+func (s *Server) leaseValid() bool {
+	needed := s.quorumSize() - s.selfCount()
+	if needed <= 0 {
+		return true
+	}
+	acks := make([]time.Time, 0, len(s.configuration.Members))
+	for _, peer := range s.voterPeers() {
+		acks = append(acks, s.lastAck[peer.Addr])
+	}
+	sort.Slice(acks, func(i, j int) bool { return acks[i].After(acks[j]) })
+
+	quorumAck := acks[needed-1]
+	return s.clock.Now().Sub(quorumAck) < LEASE_DURATION
+}
+
+// Must be called with isLeaderMutex held
+func (s *Server) recordAck(addr string, sentAt time.Time) {
+	if sentAt.After(s.lastAck[addr]) {
+		s.lastAck[addr] = sentAt
+	}
+}
+
+// Reports whether some leader may still hold a lease: we are a leader
+// holding one, or we heard from a leader within the minimum election
+// timeout. Must be called with isLeaderMutex held.
+func (s *Server) leaderMayHoldLease() bool {
+	if s.isLeader {
+		return s.leaseValid()
+	}
+	return s.clock.Now().Sub(s.lastLeaderContact) < ELECTION_TIMEOUT_MIN
+}
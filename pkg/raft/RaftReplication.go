@@ -0,0 +1,376 @@
+package raft
+
+import (
+	context "context"
+	"log"
+)
+
+// Sends one AppendEntries to addr carrying the entries from its nextIndex
+// on, then updates nextIndex and matchIndex from the reply. Returns nil if
+// the server could not be reached or we are no longer the leader of term.
+func (s *Server) replicateTo(addr string, term int64) *AppendEntryOutput {
+	if s.crashed() {
+		return nil
+	}
+
+	s.isLeaderMutex.Lock()
+	send := s.nextAppend(addr, term)
+	s.isLeaderMutex.Unlock()
+	if send == nil {
+		return nil
+	}
+	return send()
+}
+
+// Takes the entries from addr's nextIndex on and returns the function that
+// sends them, as replicateTo does, or nil if we are no longer the leader of
+// term. nextIndex is moved past the entries right away, so further calls
+// can send what follows without waiting for the reply; it is moved back if
+// the follower rejects them or can't be reached. Must be called with
+// isLeaderMutex held.
+func (s *Server) nextAppend(addr string, term int64) func() *AppendEntryOutput {
+	if !s.isLeader || s.term != term {
+		return nil
+	}
+	nextIndex := s.nextIndex[addr]
+	if nextIndex <= s.snapshotIndex {
+		// the entries it needs were compacted away
+		s.nextIndex[addr] = s.snapshotIndex + 1
+		return func() *AppendEntryOutput {
+			return s.sendSnapshot(addr, term, nextIndex)
+		}
+	}
+	entries := s.entriesFrom(nextIndex)
+	if len(entries) > MAX_ENTRIES_PER_APPEND {
+		entries = entries[:MAX_ENTRIES_PER_APPEND]
+	}
+	input := &AppendEntryInput{
+		Term:         term,
+		PrevLogIndex: nextIndex - 1,
+		PrevLogTerm:  s.termAt(nextIndex - 1),
+		Entries:      entries,
+		LeaderCommit: s.commitIndex,
+		LeaderId:     s.serverId,
+	}
+	s.nextIndex[addr] = nextIndex + int64(len(entries))
+	return func() *AppendEntryOutput {
+		return s.sendAppend(addr, term, nextIndex, input)
+	}
+}
+
+func (s *Server) sendAppend(addr string, term int64, nextIndex int64, input *AppendEntryInput) *AppendEntryOutput {
+	ctx, cancel := s.clock.WithTimeout(context.Background(), RAFT_RPC_TIMEOUT)
+	defer cancel()
+	sentAt := s.clock.Now()
+	output, err := s.transport.AppendEntries(ctx, addr, input)
+
+	s.isLeaderMutex.Lock()
+	defer s.isLeaderMutex.Unlock()
+	if err != nil {
+		// resend the entries once it is reachable again
+		s.rewindNextIndex(addr, nextIndex)
+		return nil
+	}
+	s.updateTerm(output.Term)
+	if !s.isLeader || s.term != term {
+		return output
+	}
+	s.recordAck(addr, sentAt)
+
+	if output.Success {
+		if output.MatchedIndex > s.matchIndex[addr] {
+			s.matchIndex[addr] = output.MatchedIndex
+		}
+		if output.MatchedIndex+1 > s.nextIndex[addr] {
+			s.nextIndex[addr] = output.MatchedIndex + 1
+		}
+		s.advanceCommitIndex()
+	} else {
+		// the follower has no matching entry at prevLogIndex
+		s.rewindNextIndex(addr, s.nextIndexAfterConflict(output, nextIndex))
+	}
+
+	return output
+}
+
+// Moves nextIndex for addr back to idx, unless it is already further back.
+// Never goes below what the follower is known to hold, as replies to
+// pipelined requests can arrive in any order. Must be called with
+// isLeaderMutex held.
+func (s *Server) rewindNextIndex(addr string, idx int64) {
+	if idx <= s.matchIndex[addr] {
+		idx = s.matchIndex[addr] + 1
+	}
+	if idx < s.nextIndex[addr] {
+		s.nextIndex[addr] = idx
+	}
+}
+
+// The AppendEntries in flight to one follower while we lead term
+type replicator struct {
+	term       int64
+	inflight   int
+	backingOff bool
+}
+
+// Keeps the follower at addr up to date for as long as we lead and it is a
+// member, with up to MAX_INFLIGHT_APPENDS AppendEntries in flight. Called
+// whenever entries are appended and whenever a reply comes back. After a
+// failed request it waits for the next heartbeat before trying again. Must
+// be called with isLeaderMutex held.
+func (s *Server) replicate(addr string) {
+	r, ok := s.replicators[addr]
+	if !ok || s.crashed() {
+		return
+	}
+	for r.inflight < MAX_INFLIGHT_APPENDS && !r.backingOff && s.nextIndex[addr] <= s.lastLogIndex() {
+		send := s.nextAppend(addr, r.term)
+		if send == nil {
+			return
+		}
+		r.inflight++
+		s.clock.Go(func() {
+			reached := send() != nil
+
+			s.isLeaderMutex.Lock()
+			defer s.isLeaderMutex.Unlock()
+			r.inflight--
+			r.backingOff = r.backingOff || !reached
+			if s.replicators[addr] == r {
+				s.replicate(addr)
+			}
+		})
+	}
+}
+
+// Starts replicating to every peer we don't replicate to yet, and stops for
+// those that were removed. Must be called with isLeaderMutex held.
+func (s *Server) startReplicators() {
+	if !s.isLeader {
+		return
+	}
+	peers := make(map[string]bool)
+	for _, peer := range s.peers() {
+		peers[peer.Addr] = true
+		if _, ok := s.replicators[peer.Addr]; !ok {
+			s.replicators[peer.Addr] = &replicator{term: s.term}
+		}
+	}
+	// replies from removed peers are ignored
+	for addr := range s.replicators {
+		if !peers[addr] {
+			delete(s.replicators, addr)
+		}
+	}
+}
+
+// Sends newly appended entries to every follower, in the order of the
+// configuration so a simulated run replays exactly. Never blocks. Must be
+// called with isLeaderMutex held.
+func (s *Server) notifyReplicators() {
+	for _, peer := range s.peers() {
+		s.replicate(peer.Addr)
+	}
+}
+
+// Uses the follower's conflict hints to skip back past every entry of the
+// conflicting term at once, instead of one entry per round trip.
+// Must be called with isLeaderMutex held.
+func (s *Server) nextIndexAfterConflict(output *AppendEntryOutput, nextIndex int64) int64 {
+	if output.ConflictIndex < 0 {
+		// no hint, back up a single entry
+		return nextIndex - 1
+	}
+
+	newNextIndex := output.ConflictIndex
+	if output.ConflictTerm != -1 {
+		// if we have entries from the conflicting term, resume right after
+		// our last one
+		for idx := nextIndex - 1; idx > s.snapshotIndex; idx-- {
+			if s.entryAt(idx).Term == output.ConflictTerm {
+				newNextIndex = idx + 1
+				break
+			}
+			if s.entryAt(idx).Term < output.ConflictTerm {
+				break
+			}
+		}
+	}
+
+	if newNextIndex >= nextIndex {
+		return nextIndex - 1
+	}
+	return newNextIndex
+}
+
+// If there exists an N such that N > commitIndex, a majority
+// of matchIndex[i] ≥ N, and log[N].term == currentTerm:
+// set commitIndex = N (§5.3, §5.4).
+// Must be called with isLeaderMutex held.
+func (s *Server) advanceCommitIndex() {
+	for n := s.lastLogIndex(); n > s.commitIndex && s.termAt(n) == s.term; n-- {
+		// the leader always holds its own entries
+		replicas := s.selfCount()
+		for _, peer := range s.voterPeers() {
+			if s.matchIndex[peer.Addr] >= n {
+				replicas++
+			}
+		}
+		if replicas >= s.quorumSize() {
+			s.commitIndex = n
+			s.wakeApplier()
+			// tell the followers right away rather than on the next tick
+			s.triggerHeartbeat()
+			return
+		}
+	}
+}
+
+// Queues the applier, unless it is queued or running already or there is
+// nothing to apply. Must be called with isLeaderMutex held whenever
+// commitIndex moves or a snapshot arrives.
+func (s *Server) wakeApplier() {
+	if s.applying || (s.lastApplied >= s.commitIndex && s.pendingRestore == nil) {
+		return
+	}
+	s.applying = true
+	s.clock.Go(s.runApplier)
+}
+
+// Runs until the FSM caught up with commitIndex, on leaders and followers
+// alike. It is the only place the FSM is touched once the server started,
+// and wakeApplier only ever runs one at a time, so entries reach it exactly
+// once and in log order, whichever handler moved commitIndex, and snapshots
+// from the leader are restored between them. The FSM is called without
+// isLeaderMutex held, so a slow Apply or Snapshot doesn't hold up elections
+// and replication.
+func (s *Server) runApplier() {
+	for {
+		s.isLeaderMutex.Lock()
+		if s.isStopped() || (s.lastApplied >= s.commitIndex && s.pendingRestore == nil) {
+			s.applying = false
+			s.isLeaderMutex.Unlock()
+			return
+		}
+		if snapshot := s.pendingRestore; snapshot != nil {
+			s.pendingRestore = nil
+			s.isLeaderMutex.Unlock()
+			s.restoreSnapshot(snapshot)
+			continue
+		}
+		batch := s.takeCommitted()
+		s.isLeaderMutex.Unlock()
+
+		s.applyCommitted(batch)
+		s.maybeSnapshot()
+	}
+}
+
+// Takes every committed entry that hasn't been applied yet, along with the
+// Propose calls waiting on them, and moves lastApplied past them. Must be
+// called with isLeaderMutex held.
+func (s *Server) takeCommitted() []*committedEntry {
+	batch := make([]*committedEntry, 0, s.commitIndex-s.lastApplied)
+	for s.lastApplied < s.commitIndex {
+		s.lastApplied++
+		batch = append(batch, &committedEntry{
+			index:     s.lastApplied,
+			entry:     s.entryAt(s.lastApplied),
+			committed: s.pendingCommits[s.lastApplied],
+		})
+		delete(s.pendingCommits, s.lastApplied)
+	}
+	s.configurationCommitted()
+	return batch
+}
+
+// Applies a batch takeCommitted returned in log order, and hands what the
+// FSM returned to the Propose calls waiting on it. Called by the applier
+// without isLeaderMutex held.
+func (s *Server) applyCommitted(batch []*committedEntry) {
+	for _, committed := range batch {
+		var result interface{}
+		if committed.entry.Type == EntryType_COMMAND {
+			result = s.fsm.Apply(committed.entry.Command)
+		}
+		if committed.committed != nil {
+			committed.committed <- &ProposalResult{Result: result}
+		}
+	}
+
+	s.isLeaderMutex.Lock()
+	s.fsmIndex = batch[len(batch)-1].index
+	s.commitCond.Broadcast()
+	s.isLeaderMutex.Unlock()
+}
+
+// Resets the FSM to a snapshot InstallSnapshot received, unless the applier
+// got past it meanwhile. Called by the applier without isLeaderMutex held.
+func (s *Server) restoreSnapshot(snapshot *Snapshot) {
+	s.isLeaderMutex.RLock()
+	// only the applier moves lastApplied
+	applied := s.lastApplied >= snapshot.LastIncludedIndex
+	s.isLeaderMutex.RUnlock()
+	if applied {
+		return
+	}
+
+	if err := s.fsm.Restore(snapshot.Data); err != nil {
+		log.Fatal("Error restoring a snapshot: ", err)
+	}
+
+	s.isLeaderMutex.Lock()
+	defer s.isLeaderMutex.Unlock()
+	s.lastApplied = snapshot.LastIncludedIndex
+	s.fsmIndex = snapshot.LastIncludedIndex
+	s.commitCond.Broadcast()
+	s.configurationCommitted()
+}
+
+// Fails every Propose still waiting for its entry to commit, once we are no
+// longer the leader that appended them. Must be called with isLeaderMutex held.
+func (s *Server) failPendingCommits() {
+	for idx, committed := range s.pendingCommits {
+		committed <- &ProposalResult{Err: s.notLeaderError()}
+		delete(s.pendingCommits, idx)
+	}
+}
+
+// Appends the commands proposed since the last append, up to
+// MAX_APPEND_BATCH of them, registering each for its commit result, and
+// hands them to the replicators. Whatever is proposed while a batch is
+// being written goes into the next one, so concurrent proposals share a
+// single append and fsync. Queued by ProposeAsync.
+func (s *Server) appendProposals() {
+	s.isLeaderMutex.Lock()
+	defer s.isLeaderMutex.Unlock()
+
+	batch := s.proposals
+	s.proposals = nil
+	if len(batch) > MAX_APPEND_BATCH {
+		batch, s.proposals = batch[:MAX_APPEND_BATCH], batch[MAX_APPEND_BATCH:]
+		s.clock.Go(s.appendProposals)
+	}
+
+	if !s.isLeader || s.transferringLeadership {
+		for _, proposal := range batch {
+			proposal.committed <- &ProposalResult{Err: s.notLeaderError()}
+		}
+		return
+	}
+
+	firstIdx := s.lastLogIndex() + 1
+	for _, proposal := range batch {
+		s.log = append(s.log, &LogEntry{
+			Term:    s.term,
+			Type:    EntryType_COMMAND,
+			Command: proposal.command,
+		})
+		s.pendingCommits[s.lastLogIndex()] = proposal.committed
+	}
+	s.persistLog(firstIdx)
+
+	s.notifyReplicators()
+	// a leader without voting peers commits on its own
+	s.advanceCommitIndex()
+}
@@ -0,0 +1,526 @@
+package raft
+
+import (
+	context "context"
+	"errors"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/status"
+)
+
+// One member of a Raft cluster, replicating its log to the FSM it was
+// created with
+type Server struct {
+	isLeader bool
+	term     int64
+	votedFor int64
+	log      []*LogEntry
+
+	// The leader of the current term, -1 until we hear from it
+	leaderId int64
+
+	fsm FSM
+
+	commitIndex    int64
+	pendingCommits map[int64]chan *ProposalResult
+
+	// lastApplied is the last entry the applier took from the log, fsmIndex
+	// the last one the FSM finished applying, which reads wait for
+	lastApplied int64
+	fsmIndex    int64
+	nextIndex   map[string]int64
+	matchIndex  map[string]int64
+
+	// nil when running purely in memory
+	storage *RaftStorage
+
+	// Log compaction, s.log starts right after snapshotIndex
+	snapshot          *Snapshot
+	snapshotIndex     int64
+	snapshotTerm      int64
+	snapshotThreshold int64
+	// A snapshot from the leader the applier has yet to restore the FSM to
+	pendingRestore *Snapshot
+	// Set while the applier is queued or running, see wakeApplier
+	applying bool
+
+	// Server Info
+	ip       string
+	ipList   []string
+	serverId int64
+
+	// Cluster membership, the latest configuration in the log and the index
+	// of the entry holding it. initialConfiguration applies until the log or
+	// a snapshot holds one.
+	initialConfiguration *Configuration
+	configuration        *Configuration
+	configIndex          int64
+
+	// First log index of our term as leader, reads wait until it is
+	// committed so they see everything earlier leaders committed
+	termStartIndex int64
+
+	// Leader leases: when each follower last acknowledged an AppendEntries
+	// we sent, and on followers when we last heard from the leader
+	leaseReads        bool
+	lastAck           map[string]time.Time
+	lastLeaderContact time.Time
+
+	// Set while we hand leadership to another server, new writes and lease
+	// reads are refused until it completes or times out
+	transferringLeadership bool
+
+	// Election, the timer is nil with manualElection
+	manualElection bool
+	electionTimer  ClockTimer
+	rand           *rand.Rand
+
+	// Fires every HEARTBEAT_INTERVAL, or right away to send commits early
+	heartbeatTimer ClockTimer
+
+	// Replication: commands proposed for the next log append, and the
+	// AppendEntries in flight to each follower while we lead
+	proposals   []*proposal
+	replicators map[string]*replicator
+
+	// Leader protection. isLeaderMutex guards every field above, the log
+	// included, as handlers and the clock's callbacks run on many
+	// goroutines. The FSM is only touched by the applier, see runApplier.
+	isLeaderMutex sync.RWMutex
+
+	// Wakes State once the applier caught up
+	commitCond *sync.Cond
+
+	// How we reach the other servers, with the injected faults applied
+	transport Transport
+
+	// Time as the server sees it, and closed by Stop
+	clock    Clock
+	stopped  chan struct{}
+	stopOnce sync.Once
+
+	/*--------------- Chaos Monkey --------------*/
+	isCrashed      bool
+	isCrashedMutex sync.RWMutex
+	notCrashedCond *sync.Cond
+
+	// Dropped and delayed messages to peers, see RaftFaults.go
+	faults *networkFaults
+
+	UnimplementedRaftServer
+}
+
+// What became of a proposed command: what the FSM's Apply returned for it
+// once it committed, or why it won't
+type ProposalResult struct {
+	Result interface{}
+	Err    error
+}
+
+// A committed entry the applier took from the log, with the proposal
+// waiting on it if there is one
+type committedEntry struct {
+	index     int64
+	entry     *LogEntry
+	committed chan *ProposalResult
+}
+
+// A command waiting to be appended to the log
+type proposal struct {
+	command   []byte
+	committed chan *ProposalResult
+}
+
+// Queues command to be appended to the log, together with any others that
+// arrive meanwhile, and waits for it to commit. Returns what the FSM's Apply
+// returned for it. While no majority is reachable that means blocking until
+// enough servers are back, or until ctx ends, in which case the command may
+// still commit later.
+func (s *Server) Propose(ctx context.Context, command []byte) (interface{}, error) {
+	select {
+	case result := <-s.ProposeAsync(command):
+		return result.Result, result.Err
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+// Like Propose, but returns straight away with the channel that receives
+// the outcome. The simulation harness proposes this way, as it must never
+// block.
+func (s *Server) ProposeAsync(command []byte) <-chan *ProposalResult {
+	committed := make(chan *ProposalResult, 1)
+	if s.crashed() {
+		committed <- &ProposalResult{Err: ERR_SERVER_CRASHED}
+		return committed
+	}
+
+	s.isLeaderMutex.Lock()
+	defer s.isLeaderMutex.Unlock()
+	s.proposals = append(s.proposals, &proposal{command: command, committed: committed})
+	if len(s.proposals) == 1 {
+		s.clock.Go(s.appendProposals)
+	}
+	return committed
+}
+
+// Returns once the FSM reflects every command committed before the call, so
+// a read of the FSM that follows is linearizable. Answers straight away
+// while we hold a leader lease, otherwise goes through the ReadIndex
+// protocol, so a leader that was deposed without knowing it can't serve a
+// stale read.
+func (s *Server) ReadIndex(ctx context.Context) error {
+
+	if s.crashed() {
+		return ERR_SERVER_CRASHED
+	}
+
+	if s.leaseRead() {
+		return nil
+	}
+	return s.readIndex(ctx)
+}
+
+// 1. Reply false if term < currentTerm (§5.1)
+// 2. Reply false if log doesn’t contain an entry at prevLogIndex whose term
+// matches prevLogTerm (§5.3)
+// 3. If an existing entry conflicts with a new one (same index but different
+// terms), delete the existing entry and all that follow it (§5.3)
+// 4. Append any new entries not already in the log
+// 5. If leaderCommit > commitIndex, set commitIndex = min(leaderCommit, index
+// of last new entry)
+func (s *Server) AppendEntries(ctx context.Context, input *AppendEntryInput) (*AppendEntryOutput, error) {
+
+	if s.crashed() {
+		return nil, ERR_SERVER_CRASHED
+	}
+
+	s.isLeaderMutex.Lock()
+	defer s.isLeaderMutex.Unlock()
+
+	s.updateTerm(input.Term)
+	output := &AppendEntryOutput{
+		ServerId:      s.serverId,
+		Term:          s.term,
+		Success:       false,
+		MatchedIndex:  -1,
+		ConflictTerm:  -1,
+		ConflictIndex: -1,
+	}
+
+	// Rejections are not errors, the leader needs our term and
+	// MatchedIndex to step down or back up its nextIndex
+	//
+	//1. Reply false if term < currentTerm (§5.1)
+	if input.Term < s.term {
+		return output, nil
+	}
+
+	// a valid leader exists for this term, so don't start an election
+	s.resetElectionTimer()
+	s.leaderId = input.LeaderId
+	s.lastLeaderContact = s.clock.Now()
+
+	//2. Reply false if log doesn’t contain an entry at prevLogIndex whose term
+	//matches prevLogTerm (§5.3)
+	// The conflict hints let the leader skip back a whole term at a time:
+	// either our log is too short, or we return the conflicting term and
+	// the first index we hold for it.
+	prevLogIndex, entries := input.PrevLogIndex, input.Entries
+	if prevLogIndex < s.snapshotIndex {
+		// everything up to the snapshot is committed and matches, skip it
+		skip := s.snapshotIndex - prevLogIndex
+		if skip > int64(len(entries)) {
+			skip = int64(len(entries))
+		}
+		prevLogIndex, entries = prevLogIndex+skip, entries[skip:]
+	}
+	if prevLogIndex > s.lastLogIndex() {
+		output.ConflictIndex = s.lastLogIndex() + 1
+		return output, nil
+	}
+	if prevLogIndex > s.snapshotIndex && s.termAt(prevLogIndex) != input.PrevLogTerm {
+		output.ConflictTerm = s.termAt(prevLogIndex)
+		output.ConflictIndex = prevLogIndex
+		for output.ConflictIndex-1 > s.snapshotIndex && s.termAt(output.ConflictIndex-1) == output.ConflictTerm {
+			output.ConflictIndex--
+		}
+		return output, nil
+	}
+
+	//3. If an existing entry conflicts with a new one (same index but different
+	//terms), delete the existing entry and all that follow it (§5.3)
+	//4. Append any new entries not already in the log
+	for i, entry := range entries {
+		logIdx := prevLogIndex + 1 + int64(i)
+		if logIdx <= s.lastLogIndex() && s.termAt(logIdx) == entry.Term {
+			continue
+		}
+		s.replaceEntriesFrom(logIdx, entries[i:])
+		s.persistLog(logIdx)
+		s.refreshConfiguration()
+		break
+	}
+	lastNewIdx := prevLogIndex + int64(len(entries))
+
+	//5. If leaderCommit > commitIndex, set commitIndex = min(leaderCommit, index
+	//of last new entry)
+	// (entries we already compacted can make the last new index smaller)
+	newCommitIndex := int64(math.Min(float64(input.LeaderCommit), float64(lastNewIdx)))
+	if newCommitIndex > s.commitIndex {
+		s.commitIndex = newCommitIndex
+	}
+
+	s.wakeApplier()
+
+	output.Success = true
+	output.MatchedIndex = lastNewIdx
+
+	return output, nil
+}
+
+// 1. Reply false if term < currentTerm (§5.1)
+// 2. If votedFor is null or candidateId, and candidate’s log is at
+// least as up-to-date as receiver’s log, grant vote (§5.2, §5.4)
+func (s *Server) RequestVote(ctx context.Context, input *RequestVoteInput) (*RequestVoteOutput, error) {
+
+	if s.crashed() {
+		return nil, ERR_SERVER_CRASHED
+	}
+
+	s.isLeaderMutex.Lock()
+	defer s.isLeaderMutex.Unlock()
+
+	// a leader may be serving reads under its lease, which is only safe
+	// while no one else can win an election (§6.4.1). A leader handing
+	// over stops serving them first.
+	if s.leaseReads && !input.LeadershipTransfer && s.leaderMayHoldLease() {
+		return &RequestVoteOutput{ServerId: s.serverId, Term: s.term, VoteGranted: false}, nil
+	}
+
+	// A pre-vote is granted if we would vote for the candidate in its next
+	// term, unless we still hear from a leader, leaving our state untouched
+	if input.PreVote {
+		heardFromLeader := s.isLeader || s.clock.Now().Sub(s.lastLeaderContact) < ELECTION_TIMEOUT_MIN
+		granted := input.Term > s.term && !heardFromLeader && s.logUpToDate(input.LastLogIndex, input.LastLogTerm)
+		return &RequestVoteOutput{ServerId: s.serverId, Term: s.term, VoteGranted: granted}, nil
+	}
+
+	s.updateTerm(input.Term)
+
+	output := &RequestVoteOutput{
+		ServerId:    s.serverId,
+		Term:        s.term,
+		VoteGranted: false,
+	}
+
+	//1. Reply false if term < currentTerm (§5.1)
+	if input.Term < s.term {
+		return output, nil
+	}
+
+	//2. If votedFor is null or candidateId, and candidate’s log is at
+	//least as up-to-date as receiver’s log, grant vote (§5.2, §5.4)
+	upToDate := s.logUpToDate(input.LastLogIndex, input.LastLogTerm)
+	if (s.votedFor == -1 || s.votedFor == input.CandidateId) && upToDate {
+		s.votedFor = input.CandidateId
+		s.persistState()
+		output.VoteGranted = true
+		s.resetElectionTimer()
+	}
+
+	return output, nil
+}
+
+// Makes this server the leader of the next term as if it had just won an
+// election. Elections normally happen on their own; this is kept as an
+// override for tests.
+func (s *Server) SetLeader() error {
+
+	if s.crashed() {
+		return errors.New("node is crashed.")
+	}
+	s.isLeaderMutex.Lock()
+	s.term += 1
+	s.votedFor = s.serverId
+	s.persistState()
+	s.becomeLeader()
+	s.isLeaderMutex.Unlock()
+
+	return nil
+}
+
+// Sends a round of AppendEntries to the other servers, reporting whether a
+// majority accepted it. Only leaders send them, others report false.
+func (s *Server) SendHeartbeat() (bool, error) {
+	s.isLeaderMutex.RLock()
+	isLeader := s.isLeader
+	term := s.term
+	s.isLeaderMutex.RUnlock()
+	if !isLeader || s.crashed() {
+		return false, nil
+	}
+	return s.heartbeatRound(term)
+}
+
+// Sends one AppendEntries to every follower as the leader of term. Succeeds
+// if a majority of voters, counting ourselves, accepted it; learners are not
+// waited for.
+func (s *Server) heartbeatRound(term int64) (bool, error) {
+	s.isLeaderMutex.RLock()
+	peers := s.voterPeers()
+	learners := s.learnerPeers()
+	quorumSize := s.quorumSize()
+	// the leader counts itself, unless it is being removed
+	selfCount := s.selfCount()
+	s.isLeaderMutex.RUnlock()
+
+	for _, learner := range learners {
+		go s.replicateTo(learner.Addr, term)
+	}
+
+	heartbeatChan := make(chan *AppendEntryOutput, len(peers))
+	for _, peer := range peers {
+		go func(addr string) {
+			heartbeatChan <- s.replicateTo(addr, term)
+		}(peer.Addr)
+	}
+
+	serversAlive := selfCount
+	serversCrashed := 0
+	for responses := 0; responses < len(peers); responses++ {
+		output := <-heartbeatChan
+		if output == nil {
+			serversCrashed++
+			continue
+		}
+		if output.Term > term {
+			// replicateTo already stepped us down
+			return false, nil
+		}
+		if output.Success {
+			serversAlive++
+		}
+	}
+
+	if selfCount+len(peers)-serversCrashed < quorumSize {
+		return false, errors.New("ERR_SERVERS_CRASHED")
+	}
+	return serversAlive >= quorumSize, nil
+}
+
+// Makes the server act as if it crashed, without losing its state: it
+// refuses every RPC until Restore is called. For tests.
+func (s *Server) Crash() {
+	s.isCrashedMutex.Lock()
+	s.isCrashed = true
+	s.isCrashedMutex.Unlock()
+}
+
+func (s *Server) Restore() {
+	s.isCrashedMutex.Lock()
+	s.isCrashed = false
+	s.notCrashedCond.Broadcast()
+	s.isCrashedMutex.Unlock()
+
+	// a restored leader resumes sending heartbeats until it learns of a newer term
+	s.isLeaderMutex.Lock()
+	if s.isLeader {
+		s.triggerHeartbeat()
+	}
+	s.isLeaderMutex.Unlock()
+}
+
+// The crash flag is written by Crash and Restore and read by every handler,
+// so it is only accessed under isCrashedMutex
+func (s *Server) crashed() bool {
+	s.isCrashedMutex.RLock()
+	defer s.isCrashedMutex.RUnlock()
+	return s.isCrashed
+}
+
+func (s *Server) IsCrashed() bool {
+	return s.crashed()
+}
+
+// What a server holds, for tests and monitoring
+type State struct {
+	IsLeader      bool
+	Term          int64
+	Log           []*LogEntry
+	Configuration *Configuration
+}
+
+// Crashed servers still answer, so tests can inspect them. The log is
+// copied, as it keeps changing while the caller looks at it. Waits for the
+// applier first, so the FSM holds every committed entry by the time it returns.
+func (s *Server) State() *State {
+	s.isLeaderMutex.Lock()
+	defer s.isLeaderMutex.Unlock()
+
+	for s.fsmIndex < s.commitIndex && !s.isStopped() {
+		s.commitCond.Wait()
+	}
+
+	return &State{
+		IsLeader:      s.isLeader,
+		Term:          s.term,
+		Log:           append([]*LogEntry{}, s.log...),
+		Configuration: s.configuration,
+	}
+}
+
+// Our own progress, and while we lead that of every peer, for operators.
+// Unlike State it leaves out the log, so it stays small however long that is.
+func (s *Server) ClusterStatus() *ClusterStatus {
+	s.isLeaderMutex.RLock()
+	defer s.isLeaderMutex.RUnlock()
+
+	status := &ClusterStatus{
+		ServerId:      s.serverId,
+		Role:          Role_NON_MEMBER,
+		Term:          s.term,
+		LeaderId:      s.leaderId,
+		CommitIndex:   s.commitIndex,
+		LastApplied:   s.fsmIndex,
+		LastLogIndex:  s.lastLogIndex(),
+		Configuration: s.configuration,
+	}
+	for _, member := range s.configuration.Members {
+		if member.ServerId != s.serverId {
+			continue
+		}
+		switch {
+		case s.isLeader:
+			status.Role = Role_LEADER
+		case member.Learner:
+			status.Role = Role_LEARNER
+		default:
+			status.Role = Role_FOLLOWER
+		}
+	}
+	if !s.isLeader {
+		return status
+	}
+
+	now := s.clock.Now()
+	for _, peer := range s.peers() {
+		lastAckMs := int64(-1)
+		if lastAck, ok := s.lastAck[peer.Addr]; ok {
+			lastAckMs = now.Sub(lastAck).Milliseconds()
+		}
+		status.Peers = append(status.Peers, &PeerStatus{
+			ServerId:   peer.ServerId,
+			Addr:       peer.Addr,
+			MatchIndex: s.matchIndex[peer.Addr],
+			NextIndex:  s.nextIndex[peer.Addr],
+			LastAckMs:  lastAckMs,
+		})
+	}
+	return status
+}
+
+var _ RaftInterface = new(Server)
@@ -0,0 +1,200 @@
+package raft
+
+import (
+	context "context"
+	"log"
+)
+
+// s.log only holds the entries after the snapshot, so every index into it
+// goes through these helpers. All of them must be called with isLeaderMutex held.
+
+func (s *Server) lastLogIndex() int64 {
+	return s.snapshotIndex + int64(len(s.log))
+}
+
+func (s *Server) entryAt(idx int64) *LogEntry {
+	return s.log[idx-s.snapshotIndex-1]
+}
+
+// Also answers for the last entry in the snapshot, and 0 for index -1
+func (s *Server) termAt(idx int64) int64 {
+	if idx == s.snapshotIndex {
+		return s.snapshotTerm
+	}
+	return s.entryAt(idx).Term
+}
+
+// Returns a copy of the entries from idx to the end of the log
+func (s *Server) entriesFrom(idx int64) []*LogEntry {
+	entries := make([]*LogEntry, s.lastLogIndex()-idx+1)
+	copy(entries, s.log[idx-s.snapshotIndex-1:])
+	return entries
+}
+
+// Replaces everything from idx on with entries
+func (s *Server) replaceEntriesFrom(idx int64, entries []*LogEntry) {
+	s.log = append(s.log[:idx-s.snapshotIndex-1], entries...)
+}
+
+// Compacts the log once enough entries have been applied since the last
+// snapshot. Only called by the applier, between batches, so the FSM holds
+// exactly the entries up to lastApplied. The FSM is serialized and the
+// snapshot written without isLeaderMutex held, the lock is only taken to
+// read the log and to compact it.
+func (s *Server) maybeSnapshot() {
+	s.isLeaderMutex.RLock()
+	if s.pendingRestore != nil || s.lastApplied-s.snapshotIndex < s.snapshotThreshold {
+		s.isLeaderMutex.RUnlock()
+		return
+	}
+	snapshotIndex := s.lastApplied
+	snapshotTerm := s.termAt(snapshotIndex)
+	configuration, _ := s.configurationAt(snapshotIndex)
+	s.isLeaderMutex.RUnlock()
+
+	data, err := s.fsm.Snapshot()
+	if err != nil {
+		log.Println("Error taking a snapshot, keeping the log: ", err)
+		return
+	}
+	snapshot := &Snapshot{
+		LastIncludedIndex: snapshotIndex,
+		LastIncludedTerm:  snapshotTerm,
+		Configuration:     configuration,
+		Data:              data,
+	}
+	s.persistSnapshotData(snapshot)
+
+	s.isLeaderMutex.Lock()
+	defer s.isLeaderMutex.Unlock()
+	if snapshot.LastIncludedIndex <= s.snapshotIndex {
+		// a snapshot from the leader got at least this far meanwhile
+		return
+	}
+	s.compactLog(snapshot)
+	s.persistCompactedLog()
+}
+
+// Makes snapshot the start of the log, keeping the entries after it if the
+// log holds its last included entry and discarding the whole log otherwise.
+// Must be called with isLeaderMutex held.
+func (s *Server) compactLog(snapshot *Snapshot) {
+	if snapshot.LastIncludedIndex <= s.lastLogIndex() && s.termAt(snapshot.LastIncludedIndex) == snapshot.LastIncludedTerm {
+		// copy so the compacted entries can be garbage collected
+		remaining := make([]*LogEntry, s.lastLogIndex()-snapshot.LastIncludedIndex)
+		copy(remaining, s.log[snapshot.LastIncludedIndex-s.snapshotIndex:])
+		s.log = remaining
+	} else {
+		s.log = make([]*LogEntry, 0)
+	}
+	s.snapshotIndex = snapshot.LastIncludedIndex
+	s.snapshotTerm = snapshot.LastIncludedTerm
+	s.snapshot = snapshot
+	s.refreshConfiguration()
+}
+
+// 1. Reply immediately if term < currentTerm
+// 2. If existing log entry has same index and term as snapshot’s
+// last included entry, retain log entries following it and reply
+// 3. Discard the entire log
+// 4. Reset state machine using snapshot contents
+func (s *Server) InstallSnapshot(ctx context.Context, input *InstallSnapshotInput) (*InstallSnapshotOutput, error) {
+
+	if s.crashed() {
+		return nil, ERR_SERVER_CRASHED
+	}
+
+	s.isLeaderMutex.Lock()
+	defer s.isLeaderMutex.Unlock()
+
+	s.updateTerm(input.Term)
+	output := &InstallSnapshotOutput{
+		ServerId: s.serverId,
+		Term:     s.term,
+	}
+
+	//1. Reply immediately if term < currentTerm
+	if input.Term < s.term {
+		return output, nil
+	}
+
+	// a valid leader exists for this term, so don't start an election
+	s.resetElectionTimer()
+	s.leaderId = input.LeaderId
+	s.lastLeaderContact = s.clock.Now()
+
+	snapshot := input.Snapshot
+	if snapshot.LastIncludedIndex <= s.snapshotIndex {
+		// we already compacted at least this far
+		return output, nil
+	}
+
+	//2. If existing log entry has same index and term as snapshot’s
+	//last included entry, retain log entries following it and reply
+	//3. Discard the entire log
+	s.compactLog(snapshot)
+
+	//4. Reset state machine using snapshot contents
+	// (the applier does it, between the batches it applies)
+	if s.lastApplied < s.snapshotIndex {
+		s.pendingRestore = snapshot
+	}
+	if s.commitIndex < s.snapshotIndex {
+		s.commitIndex = s.snapshotIndex
+	}
+	s.wakeApplier()
+	s.persistSnapshot()
+
+	return output, nil
+}
+
+// Sends our snapshot to a follower whose nextIndex has already been
+// compacted away. The reply is reported as an AppendEntryOutput matching
+// everything up to the snapshot, so callers can treat both the same way.
+// nextIndex is where the follower was before, it resumes from there if the
+// snapshot doesn't arrive.
+func (s *Server) sendSnapshot(addr string, term int64, nextIndex int64) *AppendEntryOutput {
+	s.isLeaderMutex.RLock()
+	input := &InstallSnapshotInput{
+		Term:     term,
+		LeaderId: s.serverId,
+		Snapshot: s.snapshot,
+	}
+	s.isLeaderMutex.RUnlock()
+
+	ctx, cancel := s.clock.WithTimeout(context.Background(), RAFT_RPC_TIMEOUT)
+	defer cancel()
+	sentAt := s.clock.Now()
+	output, err := s.transport.InstallSnapshot(ctx, addr, input)
+
+	s.isLeaderMutex.Lock()
+	defer s.isLeaderMutex.Unlock()
+	if err != nil {
+		s.rewindNextIndex(addr, nextIndex)
+		return nil
+	}
+	s.updateTerm(output.Term)
+	result := &AppendEntryOutput{
+		ServerId:      output.ServerId,
+		Term:          output.Term,
+		Success:       false,
+		MatchedIndex:  -1,
+		ConflictTerm:  -1,
+		ConflictIndex: -1,
+	}
+	if !s.isLeader || s.term != term {
+		return result
+	}
+	s.recordAck(addr, sentAt)
+
+	result.Success = true
+	result.MatchedIndex = input.Snapshot.LastIncludedIndex
+	if result.MatchedIndex > s.matchIndex[addr] {
+		s.matchIndex[addr] = result.MatchedIndex
+	}
+	if result.MatchedIndex+1 > s.nextIndex[addr] {
+		s.nextIndex[addr] = result.MatchedIndex + 1
+	}
+	s.advanceCommitIndex()
+	return result
+}
@@ -0,0 +1,368 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Each record in the write-ahead log is a 4 byte length, a 4 byte CRC-32 of
+// the payload and the payload itself, a marshalled WALRecord. A record that
+// is cut short or fails its checksum can only come from a crash mid-write,
+// so replay stops there and the file is truncated back to the last good record.
+// The snapshot file holds a single record of the same shape with a Snapshot.
+const WAL_HEADER_SIZE = 8
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Durable storage for the Raft state that must survive a restart: the
+// current term, who we voted for, the latest snapshot and the log after it
+type RaftStorage struct {
+	walPath      string
+	snapshotPath string
+	file         *os.File
+
+	// The snapshot file is written by the applier without isLeaderMutex
+	// held, so it has a lock of its own and never goes back to an earlier
+	// snapshot than the one saved
+	snapshotMutex sync.Mutex
+	savedSnapshot int64
+}
+
+// The state recovered from the snapshot and write-ahead log. log holds the
+// entries after the snapshot.
+type raftPersistentState struct {
+	term     int64
+	votedFor int64
+	snapshot *Snapshot
+	log      []*LogEntry
+}
+
+// Opens the write-ahead log and snapshot of server id in dataDir, creating
+// them if needed, and replays them
+func openRaftStorage(dataDir string, id int64) (*RaftStorage, *raftPersistentState, error) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, nil, err
+	}
+	rs := &RaftStorage{
+		walPath:      filepath.Join(dataDir, "raft-"+strconv.FormatInt(id, 10)+".wal"),
+		snapshotPath: filepath.Join(dataDir, "raft-"+strconv.FormatInt(id, 10)+".snapshot"),
+	}
+
+	snapshot, err := rs.loadSnapshot()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.OpenFile(rs.walPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	state, validSize, err := replayWAL(file, snapshot.LastIncludedIndex)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	state.snapshot = snapshot
+	rs.savedSnapshot = snapshot.LastIncludedIndex
+
+	// drop a torn record at the tail so new records follow the last good one
+	if err := file.Truncate(validSize); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if _, err := file.Seek(validSize, io.SeekStart); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	rs.file = file
+	return rs, state, nil
+}
+
+// Returns an empty snapshot if none was saved yet
+func (rs *RaftStorage) loadSnapshot() (*Snapshot, error) {
+	snapshot := &Snapshot{
+		LastIncludedIndex: -1,
+		LastIncludedTerm:  0,
+	}
+
+	file, err := os.Open(rs.snapshotPath)
+	if os.IsNotExist(err) {
+		return snapshot, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// snapshots are only ever renamed into place once complete
+	if _, err := readRecord(bufio.NewReader(file), snapshot); err != nil {
+		return nil, errors.New("corrupt snapshot " + rs.snapshotPath)
+	}
+	return snapshot, nil
+}
+
+// Reads records until the end of the file or the first bad one, returning
+// the recovered state and the size of the valid prefix. Records are indexed
+// from the start of the log, entries up to snapshotIndex are dropped.
+func replayWAL(file *os.File, snapshotIndex int64) (*raftPersistentState, int64, error) {
+	state := &raftPersistentState{
+		term:     0,
+		votedFor: -1,
+		log:      make([]*LogEntry, 0),
+	}
+
+	reader := bufio.NewReader(file)
+	validSize := int64(0)
+	for {
+		record := &WALRecord{}
+		size, err := readRecord(reader, record)
+		if err == io.EOF || err == errCorruptRecord {
+			return state, validSize, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if record.Entry == nil {
+			state.term = record.Term
+			state.votedFor = record.VotedFor
+		} else if record.Index <= snapshotIndex {
+			// left over from before the log was compacted. Everything after
+			// it was overwritten, the entry itself is in the snapshot.
+			state.log = state.log[:0]
+		} else {
+			logIdx := record.Index - snapshotIndex - 1
+			if logIdx > int64(len(state.log)) {
+				// a gap can't be written by SaveEntries, treat it as corruption
+				return state, validSize, nil
+			}
+			state.log = append(state.log[:logIdx], record.Entry)
+		}
+		validSize += size
+	}
+}
+
+var errCorruptRecord = errors.New("corrupt write-ahead log record")
+
+// Reads one record into record, returning how many bytes it took up
+func readRecord(reader io.Reader, record proto.Message) (int64, error) {
+	header := make([]byte, WAL_HEADER_SIZE)
+	if n, err := io.ReadFull(reader, header); err != nil {
+		if err == io.EOF && n == 0 {
+			return 0, io.EOF
+		}
+		if err == io.ErrUnexpectedEOF {
+			return 0, errCorruptRecord
+		}
+		return 0, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, errCorruptRecord
+		}
+		return 0, err
+	}
+	if crc32.Checksum(payload, crcTable) != checksum {
+		return 0, errCorruptRecord
+	}
+
+	if err := proto.Unmarshal(payload, record); err != nil {
+		return 0, errCorruptRecord
+	}
+	return int64(WAL_HEADER_SIZE + length), nil
+}
+
+func encodeRecord(record proto.Message) ([]byte, error) {
+	payload, err := proto.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, WAL_HEADER_SIZE+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(payload, crcTable))
+	copy(buf[WAL_HEADER_SIZE:], payload)
+	return buf, nil
+}
+
+// Writes the records and fsyncs once they are all in the file
+func (rs *RaftStorage) write(records ...*WALRecord) error {
+	buf := make([]byte, 0)
+	for _, record := range records {
+		encoded, err := encodeRecord(record)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, encoded...)
+	}
+	if _, err := rs.file.Write(buf); err != nil {
+		return err
+	}
+	return rs.file.Sync()
+}
+
+func (rs *RaftStorage) SaveState(term, votedFor int64) error {
+	return rs.write(&WALRecord{Term: term, VotedFor: votedFor})
+}
+
+// Saves entries as the log from startIdx on, replacing anything stored there
+func (rs *RaftStorage) SaveEntries(startIdx int64, entries []*LogEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	records := make([]*WALRecord, 0, len(entries))
+	for i, entry := range entries {
+		records = append(records, &WALRecord{Index: startIdx + int64(i), Entry: entry})
+	}
+	return rs.write(records...)
+}
+
+// Saves snapshot, unless a later one was saved already. Replay skips the
+// entries it holds, so the write-ahead log can be compacted afterwards.
+func (rs *RaftStorage) SaveSnapshot(snapshot *Snapshot) error {
+	rs.snapshotMutex.Lock()
+	defer rs.snapshotMutex.Unlock()
+	if snapshot.LastIncludedIndex <= rs.savedSnapshot {
+		return nil
+	}
+
+	encoded, err := encodeRecord(snapshot)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(rs.snapshotPath, encoded); err != nil {
+		return err
+	}
+	rs.savedSnapshot = snapshot.LastIncludedIndex
+	return nil
+}
+
+// Replaces the write-ahead log with one holding only the term, vote and
+// entries, the log after snapshotIndex
+func (rs *RaftStorage) CompactLog(snapshotIndex, term, votedFor int64, entries []*LogEntry) error {
+	records := []*WALRecord{{Term: term, VotedFor: votedFor}}
+	for i, entry := range entries {
+		records = append(records, &WALRecord{Index: snapshotIndex + 1 + int64(i), Entry: entry})
+	}
+	buf := make([]byte, 0)
+	for _, record := range records {
+		encoded, err := encodeRecord(record)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, encoded...)
+	}
+	if err := writeFileAtomic(rs.walPath, buf); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(rs.walPath, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	rs.file.Close()
+	rs.file = file
+	return nil
+}
+
+// Writes data to a temporary file and renames it over path, so a crash leaves
+// either the old or the new contents
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (rs *RaftStorage) Close() error {
+	return rs.file.Close()
+}
+
+// Saves the current term and vote. Must be called with isLeaderMutex held,
+// before the new state is acted on.
+func (s *Server) persistState() {
+	if s.storage == nil {
+		return
+	}
+	if err := s.storage.SaveState(s.term, s.votedFor); err != nil {
+		log.Fatal("Error writing raft state: ", err)
+	}
+}
+
+// Saves the log from fromIdx to the end. Must be called with isLeaderMutex
+// held, before the entries are acknowledged.
+func (s *Server) persistLog(fromIdx int64) {
+	if s.storage == nil {
+		return
+	}
+	if err := s.storage.SaveEntries(fromIdx, s.entriesFrom(fromIdx)); err != nil {
+		log.Fatal("Error writing raft log: ", err)
+	}
+}
+
+// Saves the current snapshot and compacts the write-ahead log. Must be
+// called with isLeaderMutex held.
+func (s *Server) persistSnapshot() {
+	s.persistSnapshotData(s.snapshot)
+	s.persistCompactedLog()
+}
+
+// Saves snapshot on its own, leaving the write-ahead log as it is. Doesn't
+// need isLeaderMutex.
+func (s *Server) persistSnapshotData(snapshot *Snapshot) {
+	if s.storage == nil {
+		return
+	}
+	if err := s.storage.SaveSnapshot(snapshot); err != nil {
+		log.Fatal("Error writing raft snapshot: ", err)
+	}
+}
+
+// Compacts the write-ahead log down to the entries after the current
+// snapshot, which must have been saved already. Must be called with
+// isLeaderMutex held.
+func (s *Server) persistCompactedLog() {
+	if s.storage == nil {
+		return
+	}
+	if err := s.storage.CompactLog(s.snapshotIndex, s.term, s.votedFor, s.log); err != nil {
+		log.Fatal("Error compacting raft log: ", err)
+	}
+}
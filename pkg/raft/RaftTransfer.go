@@ -0,0 +1,141 @@
+package raft
+
+import (
+	context "context"
+
+	"google.golang.org/grpc/status"
+)
+
+// Hands leadership to target (§3.10):
+// 1. Stop accepting new proposals
+// 2. Replicate the log to target until it holds every entry
+// 3. Send it TimeoutNow so it starts an election, which it wins as its log
+// is at least as up-to-date as anyone's
+// Returns Flag false, accepting writes again, if target hasn't taken over
+// within TRANSFER_TIMEOUT, or ctx's error if it ends first. Refused while a
+// configuration change hasn't committed yet or another transfer is running.
+func (s *Server) TransferLeadership(ctx context.Context, target *ClusterMember) (*Success, error) {
+	if s.crashed() {
+		return nil, ERR_SERVER_CRASHED
+	}
+
+	s.isLeaderMutex.Lock()
+	if !s.isLeader {
+		err := s.notLeaderError()
+		s.isLeaderMutex.Unlock()
+		return nil, err
+	}
+	if s.transferringLeadership {
+		s.isLeaderMutex.Unlock()
+		return nil, ERR_TRANSFER_IN_PROGRESS
+	}
+	if target.ServerId == s.serverId {
+		s.isLeaderMutex.Unlock()
+		return &Success{Flag: true}, nil
+	}
+	if !s.isVoter(target.ServerId) {
+		s.isLeaderMutex.Unlock()
+		return &Success{Flag: false}, nil
+	}
+	// the target may not know the configuration we are changing to yet
+	if s.configIndex > s.commitIndex {
+		s.isLeaderMutex.Unlock()
+		return nil, ERR_CONFIG_CHANGE_PENDING
+	}
+	//1. Stop accepting new proposals
+	s.transferringLeadership = true
+	term := s.term
+	addr := s.addrOf(target.ServerId)
+	s.isLeaderMutex.Unlock()
+
+	transferred := s.transferLeadership(ctx, addr, term)
+
+	s.isLeaderMutex.Lock()
+	s.transferringLeadership = false
+	s.isLeaderMutex.Unlock()
+	if !transferred && ctx.Err() != nil {
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+	return &Success{Flag: transferred}, nil
+}
+
+// Gives up once ctx ends or TRANSFER_TIMEOUT passed
+func (s *Server) transferLeadership(ctx context.Context, addr string, term int64) bool {
+	deadline := s.clock.Now().Add(TRANSFER_TIMEOUT)
+
+	//2. Replicate the log to target until it holds every entry
+	for {
+		output := s.replicateTo(addr, term)
+
+		s.isLeaderMutex.RLock()
+		stillLeader := s.isLeader && s.term == term
+		upToDate := s.matchIndex[addr] == s.lastLogIndex()
+		s.isLeaderMutex.RUnlock()
+		if !stillLeader {
+			return false
+		}
+		if upToDate {
+			break
+		}
+		if s.clock.Now().After(deadline) || ctx.Err() != nil {
+			return false
+		}
+		if output == nil {
+			select {
+			case <-ctx.Done():
+				return false
+			case <-s.clock.After(HEARTBEAT_INTERVAL):
+			}
+		}
+	}
+
+	//3. Send it TimeoutNow
+	if !s.sendTimeoutNow(addr, term) {
+		return false
+	}
+
+	// the target's RequestVote carries a newer term and steps us down
+	for s.clock.Now().Before(deadline) {
+		s.isLeaderMutex.RLock()
+		stillLeader := s.isLeader && s.term == term
+		s.isLeaderMutex.RUnlock()
+		if !stillLeader {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-s.clock.After(HEARTBEAT_INTERVAL / 10):
+		}
+	}
+	return false
+}
+
+func (s *Server) sendTimeoutNow(addr string, term int64) bool {
+	ctx, cancel := s.clock.WithTimeout(context.Background(), RAFT_RPC_TIMEOUT)
+	defer cancel()
+	output, err := s.transport.TimeoutNow(ctx, addr, &TimeoutNowInput{Term: term, LeaderId: s.serverId})
+	return err == nil && output.Flag
+}
+
+// Starts an election straight away, without waiting for the election timer,
+// when the leader of our term asks us to take over
+func (s *Server) TimeoutNow(ctx context.Context, input *TimeoutNowInput) (*Success, error) {
+
+	if s.crashed() {
+		return nil, ERR_SERVER_CRASHED
+	}
+
+	s.isLeaderMutex.Lock()
+	s.updateTerm(input.Term)
+	accepted := input.Term == s.term && !s.isLeader && s.isVoter(s.serverId)
+	s.isLeaderMutex.Unlock()
+	if !accepted {
+		return &Success{Flag: false}, nil
+	}
+
+	s.clock.Go(func() {
+		s.startElection(true)
+	})
+	return &Success{Flag: true}, nil
+}
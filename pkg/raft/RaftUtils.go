@@ -0,0 +1,219 @@
+package raft
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// How a Server runs, the zero value is a server on the real clock talking
+// gRPC to every server in ips as a voter
+type Options struct {
+	// Disables the election timer, so a leader is only ever chosen through SetLeader
+	ManualElection bool
+
+	// Directory for the write-ahead log, state is kept in memory only if empty
+	DataDir string
+
+	// Number of applied entries after which the log is compacted into a
+	// snapshot, SNAPSHOT_THRESHOLD if 0
+	SnapshotThreshold int64
+
+	// Lets a leader that heard from a majority within LEASE_DURATION serve
+	// reads without contacting the other servers. Only safe if every server
+	// sets it, as they then refuse to vote while a leader may hold a lease.
+	LeaseReads bool
+
+	// The configuration to start with, every server in ips as a voter if nil
+	Configuration *Configuration
+
+	// Starts outside the cluster with an empty configuration, waiting to be
+	// added through AddServer by the current leader
+	Join bool
+
+	// How RPCs reach the other servers, a GRPCTransport if nil
+	Transport Transport
+
+	// For the simulation harness: the time source, the real clock if nil,
+	// and the seed for election timeouts, taken from the clock if 0
+	Clock Clock
+	Seed  int64
+}
+
+// Creates the server at ips[id] replicating its log to fsm. With a DataDir,
+// fsm is restored from the last snapshot on disk, and the entries after it
+// are applied again once they are known to be committed.
+func NewServer(id int64, ips []string, fsm FSM, opts Options) (*Server, error) {
+	nextIndex := make(map[string]int64)
+	matchIndex := make(map[string]int64)
+	lastAck := make(map[string]time.Time)
+
+	for _, ipAddr := range ips {
+		nextIndex[ipAddr] = int64(0)
+		matchIndex[ipAddr] = int64(-1)
+	}
+
+	snapshotThreshold := opts.SnapshotThreshold
+	if snapshotThreshold <= 0 {
+		snapshotThreshold = SNAPSHOT_THRESHOLD
+	}
+
+	clock := opts.Clock
+	if clock == nil {
+		clock = realClock{}
+	}
+	seed := opts.Seed
+	if seed == 0 {
+		seed = clock.Now().UnixNano() + id
+	}
+	faults := newNetworkFaults(clock)
+	transport := opts.Transport
+	if transport == nil {
+		transport = NewGRPCTransport()
+	}
+
+	server := Server{
+		ip:       ips[id],
+		ipList:   ips,
+		serverId: id,
+
+		commitIndex:    -1,
+		pendingCommits: make(map[int64]chan *ProposalResult),
+		nextIndex:      nextIndex,
+		matchIndex:     matchIndex,
+		lastApplied:    -1,
+		fsmIndex:       -1,
+		lastAck:        lastAck,
+		leaseReads:     opts.LeaseReads,
+
+		snapshot: &Snapshot{
+			LastIncludedIndex: -1,
+			LastIncludedTerm:  0,
+		},
+		snapshotIndex:     -1,
+		snapshotTerm:      0,
+		snapshotThreshold: snapshotThreshold,
+
+		replicators: make(map[string]*replicator),
+		faults:      faults,
+		transport:   &faultyTransport{Transport: transport, faults: faults},
+
+		manualElection: opts.ManualElection,
+		rand:           rand.New(rand.NewSource(seed)),
+		clock:          clock,
+		stopped:        make(chan struct{}),
+
+		isLeader:  false,
+		term:      0,
+		votedFor:  -1,
+		leaderId:  -1,
+		fsm:       fsm,
+		log:       make([]*LogEntry, 0),
+		isCrashed: false,
+	}
+	if opts.Join {
+		server.initialConfiguration = &Configuration{}
+	} else if opts.Configuration != nil {
+		server.initialConfiguration = opts.Configuration
+	} else {
+		server.initialConfiguration = configurationFromAddrs(ips)
+	}
+	server.notCrashedCond = sync.NewCond(&server.isCrashedMutex)
+	server.commitCond = sync.NewCond(&server.isLeaderMutex)
+
+	if opts.DataDir != "" {
+		storage, state, err := openRaftStorage(opts.DataDir, id)
+		if err != nil {
+			return nil, err
+		}
+		server.storage = storage
+		server.term = state.term
+		server.votedFor = state.votedFor
+		server.log = state.log
+
+		// the snapshot only ever holds committed and applied entries
+		server.snapshot = state.snapshot
+		server.snapshotIndex = state.snapshot.LastIncludedIndex
+		server.snapshotTerm = state.snapshot.LastIncludedTerm
+		server.commitIndex = server.snapshotIndex
+		server.lastApplied = server.snapshotIndex
+		server.fsmIndex = server.snapshotIndex
+		if len(state.snapshot.Data) > 0 {
+			if err := fsm.Restore(state.snapshot.Data); err != nil {
+				return nil, err
+			}
+		}
+	}
+	server.refreshConfiguration()
+
+	return &server, nil
+}
+
+// Starts the timers behind elections and heartbeats, everything else runs
+// when they fire or when RPCs and proposals arrive. Serving the RPCs of
+// RaftInterface to the other servers is left to the caller, e.g. through
+// RegisterRaftServer.
+func (s *Server) Start() {
+	s.isLeaderMutex.Lock()
+	defer s.isLeaderMutex.Unlock()
+	if !s.manualElection {
+		s.electionTimer = s.clock.AfterFunc(s.randomElectionTimeout(), s.electionTimeout)
+	}
+	s.heartbeatTimer = s.clock.AfterFunc(HEARTBEAT_INTERVAL, s.heartbeat)
+}
+
+// Stops the timers Start started and closes the transport
+func (s *Server) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopped)
+		s.transport.Close()
+
+		s.isLeaderMutex.Lock()
+		defer s.isLeaderMutex.Unlock()
+		if s.electionTimer != nil {
+			s.electionTimer.Stop()
+		}
+		if s.heartbeatTimer != nil {
+			s.heartbeatTimer.Stop()
+		}
+		// wake State, which waits for the applier
+		s.commitCond.Broadcast()
+	})
+}
+
+// The address the server was created with
+func (s *Server) Addr() string {
+	return s.ip
+}
+
+// The error returned for client requests sent to a follower, carrying the
+// address of the leader if we know it. Must be called with isLeaderMutex held.
+func (s *Server) notLeaderError() error {
+	notLeader := &NotLeader{LeaderId: s.leaderId}
+	if s.leaderId >= 0 && s.leaderId != s.serverId {
+		notLeader.LeaderAddr = s.addrOf(s.leaderId)
+	}
+	st, err := status.New(codes.FailedPrecondition, ERR_NOT_LEADER.Error()).WithDetails(notLeader)
+	if err != nil {
+		return ERR_NOT_LEADER
+	}
+	return st.Err()
+}
+
+// Reports whether err came from a server that is not the leader, and if so
+// the leader address it suggested, empty if it knew of none
+func LeaderAddrFromError(err error) (string, bool) {
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != codes.FailedPrecondition {
+		return "", false
+	}
+	for _, detail := range st.Details() {
+		if notLeader, ok := detail.(*NotLeader); ok {
+			return notLeader.LeaderAddr, true
+		}
+	}
+	return "", false
+}
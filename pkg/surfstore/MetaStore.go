@@ -2,23 +2,78 @@ package surfstore
 
 import (
 	context "context"
+	"cse224/proj5/pkg/raft"
 	"errors"
 	"fmt"
+	"sync"
 
+	"google.golang.org/protobuf/proto"
 	emptypb "google.golang.org/protobuf/types/known/emptypb"
 )
 
 type MetaStore struct {
 	FileMetaMap    map[string]*FileMetaData
 	BlockStoreAddr string
+	// The last update applied for each client, so a retried UpdateFile
+	// returns its original result instead of being applied again
+	ClientSessions map[string]*ClientSession
+	// Guards the maps, which are read outside of Raft while it applies updates
+	mutex sync.RWMutex
 	UnimplementedMetaStoreServer
 }
 
+// The map is copied, as it keeps changing while the reply is sent
 func (m *MetaStore) GetFileInfoMap(ctx context.Context, _ *emptypb.Empty) (*FileInfoMap, error) {
-	return &FileInfoMap{FileInfoMap: m.FileMetaMap}, nil
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	fileInfoMap := make(map[string]*FileMetaData, len(m.FileMetaMap))
+	for filename, filemeta := range m.FileMetaMap {
+		fileInfoMap[filename] = filemeta
+	}
+	return &FileInfoMap{FileInfoMap: fileInfoMap}, nil
 }
 
 func (m *MetaStore) UpdateFile(ctx context.Context, fileMetaData *FileMetaData) (*Version, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if fileMetaData.ClientId == "" {
+		return m.updateFile(fileMetaData)
+	}
+
+	// clients send one update at a time, so anything up to the last
+	// sequence number we saw has been applied already
+	session, ok := m.ClientSessions[fileMetaData.ClientId]
+	if ok && fileMetaData.SequenceNum < session.SequenceNum {
+		return &Version{Version: -1}, ERR_STALE_REQUEST
+	}
+	if ok && fileMetaData.SequenceNum == session.SequenceNum {
+		if session.Error != "" {
+			return &Version{Version: session.Version}, errors.New(session.Error)
+		}
+		return &Version{Version: session.Version}, nil
+	}
+
+	// the session fields only matter for this call, don't keep them
+	stored := proto.Clone(fileMetaData).(*FileMetaData)
+	stored.ClientId = ""
+	stored.SequenceNum = 0
+	version, err := m.updateFile(stored)
+
+	session = &ClientSession{
+		ClientId:    fileMetaData.ClientId,
+		SequenceNum: fileMetaData.SequenceNum,
+		Version:     version.Version,
+	}
+	if err != nil {
+		session.Error = err.Error()
+	}
+	m.ClientSessions[fileMetaData.ClientId] = session
+	return version, err
+}
+
+func (m *MetaStore) updateFile(fileMetaData *FileMetaData) (*Version, error) {
 
 	// check version number
 	incomingVersion := fileMetaData.Version
@@ -54,5 +109,60 @@ func NewMetaStore(blockStoreAddr string) *MetaStore {
 	return &MetaStore{
 		FileMetaMap:    map[string]*FileMetaData{},
 		BlockStoreAddr: blockStoreAddr,
+		ClientSessions: map[string]*ClientSession{},
+	}
+}
+
+// What Apply returns for a FileMetaData, handed back to RaftSurfstore.UpdateFile
+type updateResult struct {
+	version *Version
+	err     error
+}
+
+// Applies an update RaftSurfstore.UpdateFile proposed, once it committed
+func (m *MetaStore) Apply(command []byte) interface{} {
+	fileMetaData := &FileMetaData{}
+	if err := proto.Unmarshal(command, fileMetaData); err != nil {
+		return &updateResult{version: &Version{Version: -1}, err: err}
+	}
+	version, err := m.UpdateFile(context.Background(), fileMetaData)
+	return &updateResult{version: version, err: err}
+}
+
+// The files and the client sessions, so retries are still recognized on a
+// server that was restored from the snapshot
+func (m *MetaStore) Snapshot() ([]byte, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	sessions := make([]*ClientSession, 0, len(m.ClientSessions))
+	for _, session := range m.ClientSessions {
+		sessions = append(sessions, session)
 	}
+	return proto.Marshal(&MetaStoreSnapshot{
+		MetaMap:        &FileInfoMap{FileInfoMap: m.FileMetaMap},
+		ClientSessions: sessions,
+	})
 }
+
+func (m *MetaStore) Restore(snapshot []byte) error {
+	restored := &MetaStoreSnapshot{}
+	if err := proto.Unmarshal(snapshot, restored); err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.FileMetaMap = make(map[string]*FileMetaData, len(restored.MetaMap.GetFileInfoMap()))
+	for filename, filemeta := range restored.MetaMap.GetFileInfoMap() {
+		m.FileMetaMap[filename] = filemeta
+	}
+	m.ClientSessions = make(map[string]*ClientSession, len(restored.ClientSessions))
+	for _, session := range restored.ClientSessions {
+		m.ClientSessions[session.ClientId] = session
+	}
+	return nil
+}
+
+// Lets Raft replicate the MetaStore
+var _ raft.FSM = new(MetaStore)
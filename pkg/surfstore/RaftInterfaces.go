@@ -2,13 +2,20 @@ package surfstore
 
 import (
 	context "context"
+	"cse224/proj5/pkg/raft"
+
 	emptypb "google.golang.org/protobuf/types/known/emptypb"
 )
 
+// Running the cluster. The RPCs between servers are raft.RaftInterface.
 type RaftInterface interface {
-	AppendEntries(ctx context.Context, input *AppendEntryInput) (*AppendEntryOutput, error)
 	SetLeader(ctx context.Context, _ *emptypb.Empty) (*Success, error)
 	SendHeartbeat(ctx context.Context, _ *emptypb.Empty) (*Success, error)
+	GetClusterStatus(ctx context.Context, _ *emptypb.Empty) (*raft.ClusterStatus, error)
+	AddServer(ctx context.Context, member *raft.ClusterMember) (*raft.Configuration, error)
+	RemoveServer(ctx context.Context, member *raft.ClusterMember) (*raft.Configuration, error)
+	PromoteLearner(ctx context.Context, member *raft.ClusterMember) (*raft.Configuration, error)
+	TransferLeadership(ctx context.Context, target *raft.ClusterMember) (*Success, error)
 }
 
 type RaftTestingInterface interface {
@@ -16,6 +23,8 @@ type RaftTestingInterface interface {
 	Crash(ctx context.Context, _ *emptypb.Empty) (*Success, error)
 	Restore(ctx context.Context, _ *emptypb.Empty) (*Success, error)
 	IsCrashed(ctx context.Context, _ *emptypb.Empty) (*CrashedState, error)
+	SetNetworkFault(ctx context.Context, fault *NetworkFault) (*Success, error)
+	ClearNetworkFaults(ctx context.Context, _ *emptypb.Empty) (*Success, error)
 }
 
 type RaftSurfstoreInterface interface {
@@ -2,18 +2,30 @@ package surfstore
 
 import (
 	"bufio"
+	"cse224/proj5/pkg/raft"
 	"io"
 	"log"
 	"net"
 	"os"
 	"strconv"
 	"strings"
-	"sync"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
 )
 
 func LoadRaftConfigFile(filename string) (ipList []string) {
+	for _, member := range LoadRaftConfiguration(filename).Members {
+		ipList = append(ipList, member.Addr)
+	}
+	return
+}
+
+// Reads the servers in the config file. A server is a learner if its
+// address is followed by the role marker, e.g.
+//
+//	metadata3: localhost:9010 learner
+func LoadRaftConfiguration(filename string) *raft.Configuration {
 	configFD, e := os.Open(filename)
 	if e != nil {
 		log.Fatal("Error Open config file:", e)
@@ -22,6 +34,7 @@ func LoadRaftConfigFile(filename string) (ipList []string) {
 
 	configReader := bufio.NewReader(configFD)
 	serverCount := 0
+	var members []*raft.ClusterMember
 
 	for index := 0; ; index++ {
 		lineContent, _, e := configReader.ReadLine()
@@ -30,63 +43,72 @@ func LoadRaftConfigFile(filename string) (ipList []string) {
 		}
 
 		if e == io.EOF {
-			return
+			return &raft.Configuration{Members: members}
 		}
 
 		lineString := string(lineContent)
 		splitRes := strings.Split(lineString, ": ")
 		if index == 0 {
 			serverCount, _ = strconv.Atoi(splitRes[1])
-			ipList = make([]string, serverCount, serverCount)
+			members = make([]*raft.ClusterMember, serverCount, serverCount)
 		} else {
-			ipList[index-1] = splitRes[1]
+			fields := strings.Fields(splitRes[1])
+			members[index-1] = &raft.ClusterMember{
+				ServerId: int64(index - 1),
+				Addr:     fields[0],
+				Learner:  len(fields) > 1 && fields[1] == LEARNER_ROLE,
+			}
 		}
 	}
-
-	return
 }
 
-func NewRaftServer(id int64, ips []string, blockStoreAddr string) (*RaftSurfstore, error) {
-	// TODO any initialization you need to do here
-
-	isCrashedMutex := sync.RWMutex{}
-	nextIndex := make(map[string]int64)
-
-	for _, ipAddr := range ips {
-		nextIndex[ipAddr] = int64(0)
-	}
+// See raft.Options
+type RaftServerOptions = raft.Options
 
-	server := RaftSurfstore{
-		// TODO initialize any fields you add here
-		ip:       ips[id],
-		ipList:   ips,
-		serverId: id,
-
-		commitIndex: -1,
-		nextIndex:   nextIndex,
-		lastApplied: -1,
-
-		isLeader:       false,
-		term:           0,
-		metaStore:      NewMetaStore(blockStoreAddr),
-		log:            make([]*UpdateOperation, 0),
-		isCrashed:      false,
-		notCrashedCond: sync.NewCond(&isCrashedMutex),
-		isCrashedMutex: isCrashedMutex,
+func NewRaftServer(id int64, ips []string, blockStoreAddr string, opts RaftServerOptions) (*RaftSurfstore, error) {
+	metaStore := NewMetaStore(blockStoreAddr)
+	server, err := raft.NewServer(id, ips, metaStore, opts)
+	if err != nil {
+		return nil, err
 	}
-
-	return &server, nil
+	return &RaftSurfstore{raft: server, metaStore: metaStore}, nil
 }
 
 // TODO Start up the Raft server and any services here
 func ServeRaftServer(server *RaftSurfstore) error {
-	s := grpc.NewServer()
+	// peers ping idle connections every PEER_KEEPALIVE_TIME
+	s := grpc.NewServer(grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+		MinTime:             raft.PEER_KEEPALIVE_TIME / 2,
+		PermitWithoutStream: true,
+	}))
 	RegisterRaftSurfstoreServer(s, server)
+	raft.RegisterRaftServer(s, server.raft)
 
-	l, e := net.Listen("tcp", server.ip)
+	l, e := net.Listen("tcp", server.raft.Addr())
 	if e != nil {
 		return e
 	}
 
+	StartRaftServer(server)
+	defer StopRaftServer(server)
+
 	return s.Serve(l)
 }
+
+// Starts the timers behind elections and heartbeats, without serving RPCs.
+// ServeRaftServer calls it, the simulation harness calls it directly and
+// connects servers itself.
+func StartRaftServer(server *RaftSurfstore) {
+	server.raft.Start()
+}
+
+// Stops the timers StartRaftServer started and closes the transport
+func StopRaftServer(server *RaftSurfstore) {
+	server.raft.Stop()
+}
+
+// Reports whether err came from a server that is not the leader, and if so
+// the leader address it suggested, empty if it knew of none
+func LeaderAddrFromError(err error) (string, bool) {
+	return raft.LeaderAddrFromError(err)
+}
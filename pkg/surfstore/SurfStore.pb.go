@@ -7,6 +7,7 @@
 package surfstore
 
 import (
+	raft "cse224/proj5/pkg/raft"
 	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
 	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
 	emptypb "google.golang.org/protobuf/types/known/emptypb"
@@ -225,6 +226,9 @@ type FileMetaData struct {
 	Filename      string   `protobuf:"bytes,1,opt,name=filename,proto3" json:"filename,omitempty"`
 	Version       int32    `protobuf:"varint,2,opt,name=version,proto3" json:"version,omitempty"`
 	BlockHashList []string `protobuf:"bytes,3,rep,name=blockHashList,proto3" json:"blockHashList,omitempty"`
+	// Set by clients so a retried UpdateFile is applied only once
+	ClientId    string `protobuf:"bytes,4,opt,name=clientId,proto3" json:"clientId,omitempty"`
+	SequenceNum int64  `protobuf:"varint,5,opt,name=sequenceNum,proto3" json:"sequenceNum,omitempty"`
 }
 
 func (x *FileMetaData) Reset() {
@@ -280,6 +284,20 @@ func (x *FileMetaData) GetBlockHashList() []string {
 	return nil
 }
 
+func (x *FileMetaData) GetClientId() string {
+	if x != nil {
+		return x.ClientId
+	}
+	return ""
+}
+
+func (x *FileMetaData) GetSequenceNum() int64 {
+	if x != nil {
+		return x.SequenceNum
+	}
+	return 0
+}
+
 type FileInfoMap struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -468,20 +486,22 @@ func (x *CrashedState) GetIsCrashed() bool {
 	return false
 }
 
-type AppendEntryInput struct {
+// Disturbs the RPCs a server sends to addr: each is held back for delayMs
+// plus a random part of jitterMs, which reorders pipelined requests, and
+// then lost with probability dropRate, taking as long as a timeout would
+type NetworkFault struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Term         int64              `protobuf:"varint,1,opt,name=term,proto3" json:"term,omitempty"`
-	PrevLogIndex int64              `protobuf:"varint,2,opt,name=prevLogIndex,proto3" json:"prevLogIndex,omitempty"`
-	PrevLogTerm  int64              `protobuf:"varint,3,opt,name=prevLogTerm,proto3" json:"prevLogTerm,omitempty"`
-	Entries      []*UpdateOperation `protobuf:"bytes,4,rep,name=entries,proto3" json:"entries,omitempty"`
-	LeaderCommit int64              `protobuf:"varint,5,opt,name=leaderCommit,proto3" json:"leaderCommit,omitempty"`
+	Addr     string  `protobuf:"bytes,1,opt,name=addr,proto3" json:"addr,omitempty"`
+	DropRate float64 `protobuf:"fixed64,2,opt,name=dropRate,proto3" json:"dropRate,omitempty"`
+	DelayMs  int64   `protobuf:"varint,3,opt,name=delayMs,proto3" json:"delayMs,omitempty"`
+	JitterMs int64   `protobuf:"varint,4,opt,name=jitterMs,proto3" json:"jitterMs,omitempty"`
 }
 
-func (x *AppendEntryInput) Reset() {
-	*x = AppendEntryInput{}
+func (x *NetworkFault) Reset() {
+	*x = NetworkFault{}
 	if protoimpl.UnsafeEnabled {
 		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[9]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -489,13 +509,13 @@ func (x *AppendEntryInput) Reset() {
 	}
 }
 
-func (x *AppendEntryInput) String() string {
+func (x *NetworkFault) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*AppendEntryInput) ProtoMessage() {}
+func (*NetworkFault) ProtoMessage() {}
 
-func (x *AppendEntryInput) ProtoReflect() protoreflect.Message {
+func (x *NetworkFault) ProtoReflect() protoreflect.Message {
 	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[9]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -507,74 +527,124 @@ func (x *AppendEntryInput) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use AppendEntryInput.ProtoReflect.Descriptor instead.
-func (*AppendEntryInput) Descriptor() ([]byte, []int) {
+// Deprecated: Use NetworkFault.ProtoReflect.Descriptor instead.
+func (*NetworkFault) Descriptor() ([]byte, []int) {
 	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{9}
 }
 
-func (x *AppendEntryInput) GetTerm() int64 {
+func (x *NetworkFault) GetAddr() string {
 	if x != nil {
-		return x.Term
+		return x.Addr
+	}
+	return ""
+}
+
+func (x *NetworkFault) GetDropRate() float64 {
+	if x != nil {
+		return x.DropRate
 	}
 	return 0
 }
 
-func (x *AppendEntryInput) GetPrevLogIndex() int64 {
+func (x *NetworkFault) GetDelayMs() int64 {
 	if x != nil {
-		return x.PrevLogIndex
+		return x.DelayMs
 	}
 	return 0
 }
 
-func (x *AppendEntryInput) GetPrevLogTerm() int64 {
+func (x *NetworkFault) GetJitterMs() int64 {
 	if x != nil {
-		return x.PrevLogTerm
+		return x.JitterMs
 	}
 	return 0
 }
 
-func (x *AppendEntryInput) GetEntries() []*UpdateOperation {
+// What MetaStore.Snapshot hands to Raft
+type MetaStoreSnapshot struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	MetaMap        *FileInfoMap     `protobuf:"bytes,1,opt,name=metaMap,proto3" json:"metaMap,omitempty"`
+	ClientSessions []*ClientSession `protobuf:"bytes,2,rep,name=clientSessions,proto3" json:"clientSessions,omitempty"`
+}
+
+func (x *MetaStoreSnapshot) Reset() {
+	*x = MetaStoreSnapshot{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[10]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *MetaStoreSnapshot) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MetaStoreSnapshot) ProtoMessage() {}
+
+func (x *MetaStoreSnapshot) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[10]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MetaStoreSnapshot.ProtoReflect.Descriptor instead.
+func (*MetaStoreSnapshot) Descriptor() ([]byte, []int) {
+	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *MetaStoreSnapshot) GetMetaMap() *FileInfoMap {
 	if x != nil {
-		return x.Entries
+		return x.MetaMap
 	}
 	return nil
 }
 
-func (x *AppendEntryInput) GetLeaderCommit() int64 {
+func (x *MetaStoreSnapshot) GetClientSessions() []*ClientSession {
 	if x != nil {
-		return x.LeaderCommit
+		return x.ClientSessions
 	}
-	return 0
+	return nil
 }
 
-type AppendEntryOutput struct {
+// The last update applied for a client and its outcome
+type ClientSession struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	ServerId     int64 `protobuf:"varint,1,opt,name=serverId,proto3" json:"serverId,omitempty"`
-	Term         int64 `protobuf:"varint,2,opt,name=term,proto3" json:"term,omitempty"`
-	Success      bool  `protobuf:"varint,3,opt,name=success,proto3" json:"success,omitempty"`
-	MatchedIndex int64 `protobuf:"varint,4,opt,name=matchedIndex,proto3" json:"matchedIndex,omitempty"`
+	ClientId    string `protobuf:"bytes,1,opt,name=clientId,proto3" json:"clientId,omitempty"`
+	SequenceNum int64  `protobuf:"varint,2,opt,name=sequenceNum,proto3" json:"sequenceNum,omitempty"`
+	Version     int32  `protobuf:"varint,3,opt,name=version,proto3" json:"version,omitempty"`
+	Error       string `protobuf:"bytes,4,opt,name=error,proto3" json:"error,omitempty"`
 }
 
-func (x *AppendEntryOutput) Reset() {
-	*x = AppendEntryOutput{}
+func (x *ClientSession) Reset() {
+	*x = ClientSession{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[10]
+		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[11]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
 }
 
-func (x *AppendEntryOutput) String() string {
+func (x *ClientSession) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*AppendEntryOutput) ProtoMessage() {}
+func (*ClientSession) ProtoMessage() {}
 
-func (x *AppendEntryOutput) ProtoReflect() protoreflect.Message {
-	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[10]
+func (x *ClientSession) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[11]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -585,52 +655,55 @@ func (x *AppendEntryOutput) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use AppendEntryOutput.ProtoReflect.Descriptor instead.
-func (*AppendEntryOutput) Descriptor() ([]byte, []int) {
-	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{10}
+// Deprecated: Use ClientSession.ProtoReflect.Descriptor instead.
+func (*ClientSession) Descriptor() ([]byte, []int) {
+	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{11}
 }
 
-func (x *AppendEntryOutput) GetServerId() int64 {
+func (x *ClientSession) GetClientId() string {
 	if x != nil {
-		return x.ServerId
+		return x.ClientId
 	}
-	return 0
+	return ""
 }
 
-func (x *AppendEntryOutput) GetTerm() int64 {
+func (x *ClientSession) GetSequenceNum() int64 {
 	if x != nil {
-		return x.Term
+		return x.SequenceNum
 	}
 	return 0
 }
 
-func (x *AppendEntryOutput) GetSuccess() bool {
+func (x *ClientSession) GetVersion() int32 {
 	if x != nil {
-		return x.Success
+		return x.Version
 	}
-	return false
+	return 0
 }
 
-func (x *AppendEntryOutput) GetMatchedIndex() int64 {
+func (x *ClientSession) GetError() string {
 	if x != nil {
-		return x.MatchedIndex
+		return x.Error
 	}
-	return 0
+	return ""
 }
 
+// A log entry as GetInternalState reports it: the update a command holds,
+// a configuration, or neither for a no-op
 type UpdateOperation struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Term         int64         `protobuf:"varint,1,opt,name=term,proto3" json:"term,omitempty"`
-	FileMetaData *FileMetaData `protobuf:"bytes,3,opt,name=fileMetaData,proto3" json:"fileMetaData,omitempty"`
+	Term          int64               `protobuf:"varint,1,opt,name=term,proto3" json:"term,omitempty"`
+	FileMetaData  *FileMetaData       `protobuf:"bytes,3,opt,name=fileMetaData,proto3" json:"fileMetaData,omitempty"`
+	Configuration *raft.Configuration `protobuf:"bytes,4,opt,name=configuration,proto3" json:"configuration,omitempty"`
 }
 
 func (x *UpdateOperation) Reset() {
 	*x = UpdateOperation{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[11]
+		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[12]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -643,7 +716,7 @@ func (x *UpdateOperation) String() string {
 func (*UpdateOperation) ProtoMessage() {}
 
 func (x *UpdateOperation) ProtoReflect() protoreflect.Message {
-	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[11]
+	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[12]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -656,7 +729,7 @@ func (x *UpdateOperation) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use UpdateOperation.ProtoReflect.Descriptor instead.
 func (*UpdateOperation) Descriptor() ([]byte, []int) {
-	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{11}
+	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{12}
 }
 
 func (x *UpdateOperation) GetTerm() int64 {
@@ -673,21 +746,29 @@ func (x *UpdateOperation) GetFileMetaData() *FileMetaData {
 	return nil
 }
 
+func (x *UpdateOperation) GetConfiguration() *raft.Configuration {
+	if x != nil {
+		return x.Configuration
+	}
+	return nil
+}
+
 type RaftInternalState struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	IsLeader bool               `protobuf:"varint,1,opt,name=isLeader,proto3" json:"isLeader,omitempty"`
-	Term     int64              `protobuf:"varint,2,opt,name=term,proto3" json:"term,omitempty"`
-	Log      []*UpdateOperation `protobuf:"bytes,3,rep,name=log,proto3" json:"log,omitempty"`
-	MetaMap  *FileInfoMap       `protobuf:"bytes,4,opt,name=metaMap,proto3" json:"metaMap,omitempty"`
+	IsLeader      bool                `protobuf:"varint,1,opt,name=isLeader,proto3" json:"isLeader,omitempty"`
+	Term          int64               `protobuf:"varint,2,opt,name=term,proto3" json:"term,omitempty"`
+	Log           []*UpdateOperation  `protobuf:"bytes,3,rep,name=log,proto3" json:"log,omitempty"`
+	MetaMap       *FileInfoMap        `protobuf:"bytes,4,opt,name=metaMap,proto3" json:"metaMap,omitempty"`
+	Configuration *raft.Configuration `protobuf:"bytes,5,opt,name=configuration,proto3" json:"configuration,omitempty"`
 }
 
 func (x *RaftInternalState) Reset() {
 	*x = RaftInternalState{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[12]
+		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[13]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -700,7 +781,7 @@ func (x *RaftInternalState) String() string {
 func (*RaftInternalState) ProtoMessage() {}
 
 func (x *RaftInternalState) ProtoReflect() protoreflect.Message {
-	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[12]
+	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[13]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -713,7 +794,7 @@ func (x *RaftInternalState) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use RaftInternalState.ProtoReflect.Descriptor instead.
 func (*RaftInternalState) Descriptor() ([]byte, []int) {
-	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{12}
+	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{13}
 }
 
 func (x *RaftInternalState) GetIsLeader() bool {
@@ -744,6 +825,13 @@ func (x *RaftInternalState) GetMetaMap() *FileInfoMap {
 	return nil
 }
 
+func (x *RaftInternalState) GetConfiguration() *raft.Configuration {
+	if x != nil {
+		return x.Configuration
+	}
+	return nil
+}
+
 var File_pkg_surfstore_SurfStore_proto protoreflect.FileDescriptor
 
 var file_pkg_surfstore_SurfStore_proto_rawDesc = []byte{
@@ -751,150 +839,189 @@ var file_pkg_surfstore_SurfStore_proto_rawDesc = []byte{
 	0x53, 0x75, 0x72, 0x66, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12,
 	0x09, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x1a, 0x1b, 0x67, 0x6f, 0x6f, 0x67,
 	0x6c, 0x65, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2f, 0x65, 0x6d, 0x70, 0x74,
-	0x79, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0x1f, 0x0a, 0x09, 0x42, 0x6c, 0x6f, 0x63, 0x6b,
-	0x48, 0x61, 0x73, 0x68, 0x12, 0x12, 0x0a, 0x04, 0x68, 0x61, 0x73, 0x68, 0x18, 0x01, 0x20, 0x01,
-	0x28, 0x09, 0x52, 0x04, 0x68, 0x61, 0x73, 0x68, 0x22, 0x25, 0x0a, 0x0b, 0x42, 0x6c, 0x6f, 0x63,
-	0x6b, 0x48, 0x61, 0x73, 0x68, 0x65, 0x73, 0x12, 0x16, 0x0a, 0x06, 0x68, 0x61, 0x73, 0x68, 0x65,
-	0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x09, 0x52, 0x06, 0x68, 0x61, 0x73, 0x68, 0x65, 0x73, 0x22,
-	0x43, 0x0a, 0x05, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x12, 0x1c, 0x0a, 0x09, 0x62, 0x6c, 0x6f, 0x63,
-	0x6b, 0x44, 0x61, 0x74, 0x61, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x09, 0x62, 0x6c, 0x6f,
-	0x63, 0x6b, 0x44, 0x61, 0x74, 0x61, 0x12, 0x1c, 0x0a, 0x09, 0x62, 0x6c, 0x6f, 0x63, 0x6b, 0x53,
-	0x69, 0x7a, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x05, 0x52, 0x09, 0x62, 0x6c, 0x6f, 0x63, 0x6b,
-	0x53, 0x69, 0x7a, 0x65, 0x22, 0x1d, 0x0a, 0x07, 0x53, 0x75, 0x63, 0x63, 0x65, 0x73, 0x73, 0x12,
-	0x12, 0x0a, 0x04, 0x66, 0x6c, 0x61, 0x67, 0x18, 0x01, 0x20, 0x01, 0x28, 0x08, 0x52, 0x04, 0x66,
-	0x6c, 0x61, 0x67, 0x22, 0x6a, 0x0a, 0x0c, 0x46, 0x69, 0x6c, 0x65, 0x4d, 0x65, 0x74, 0x61, 0x44,
-	0x61, 0x74, 0x61, 0x12, 0x1a, 0x0a, 0x08, 0x66, 0x69, 0x6c, 0x65, 0x6e, 0x61, 0x6d, 0x65, 0x18,
-	0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x66, 0x69, 0x6c, 0x65, 0x6e, 0x61, 0x6d, 0x65, 0x12,
-	0x18, 0x0a, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x02, 0x20, 0x01, 0x28, 0x05,
-	0x52, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x24, 0x0a, 0x0d, 0x62, 0x6c, 0x6f,
-	0x63, 0x6b, 0x48, 0x61, 0x73, 0x68, 0x4c, 0x69, 0x73, 0x74, 0x18, 0x03, 0x20, 0x03, 0x28, 0x09,
-	0x52, 0x0d, 0x62, 0x6c, 0x6f, 0x63, 0x6b, 0x48, 0x61, 0x73, 0x68, 0x4c, 0x69, 0x73, 0x74, 0x22,
-	0xb1, 0x01, 0x0a, 0x0b, 0x46, 0x69, 0x6c, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x4d, 0x61, 0x70, 0x12,
-	0x49, 0x0a, 0x0b, 0x66, 0x69, 0x6c, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x4d, 0x61, 0x70, 0x18, 0x01,
-	0x20, 0x03, 0x28, 0x0b, 0x32, 0x27, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65,
-	0x2e, 0x46, 0x69, 0x6c, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x4d, 0x61, 0x70, 0x2e, 0x46, 0x69, 0x6c,
-	0x65, 0x49, 0x6e, 0x66, 0x6f, 0x4d, 0x61, 0x70, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x52, 0x0b, 0x66,
-	0x69, 0x6c, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x4d, 0x61, 0x70, 0x1a, 0x57, 0x0a, 0x10, 0x46, 0x69,
-	0x6c, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x4d, 0x61, 0x70, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x12, 0x10,
-	0x0a, 0x03, 0x6b, 0x65, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x6b, 0x65, 0x79,
-	0x12, 0x2d, 0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32,
-	0x17, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x46, 0x69, 0x6c, 0x65,
-	0x4d, 0x65, 0x74, 0x61, 0x44, 0x61, 0x74, 0x61, 0x52, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x3a,
-	0x02, 0x38, 0x01, 0x22, 0x23, 0x0a, 0x07, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x18,
-	0x0a, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x05, 0x52,
-	0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x22, 0x24, 0x0a, 0x0e, 0x42, 0x6c, 0x6f, 0x63,
-	0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x41, 0x64, 0x64, 0x72, 0x12, 0x12, 0x0a, 0x04, 0x61, 0x64,
-	0x64, 0x72, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x61, 0x64, 0x64, 0x72, 0x22, 0x2c,
-	0x0a, 0x0c, 0x43, 0x72, 0x61, 0x73, 0x68, 0x65, 0x64, 0x53, 0x74, 0x61, 0x74, 0x65, 0x12, 0x1c,
-	0x0a, 0x09, 0x69, 0x73, 0x43, 0x72, 0x61, 0x73, 0x68, 0x65, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28,
-	0x08, 0x52, 0x09, 0x69, 0x73, 0x43, 0x72, 0x61, 0x73, 0x68, 0x65, 0x64, 0x22, 0xc6, 0x01, 0x0a,
-	0x10, 0x41, 0x70, 0x70, 0x65, 0x6e, 0x64, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x49, 0x6e, 0x70, 0x75,
-	0x74, 0x12, 0x12, 0x0a, 0x04, 0x74, 0x65, 0x72, 0x6d, 0x18, 0x01, 0x20, 0x01, 0x28, 0x03, 0x52,
-	0x04, 0x74, 0x65, 0x72, 0x6d, 0x12, 0x22, 0x0a, 0x0c, 0x70, 0x72, 0x65, 0x76, 0x4c, 0x6f, 0x67,
-	0x49, 0x6e, 0x64, 0x65, 0x78, 0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0c, 0x70, 0x72, 0x65,
-	0x76, 0x4c, 0x6f, 0x67, 0x49, 0x6e, 0x64, 0x65, 0x78, 0x12, 0x20, 0x0a, 0x0b, 0x70, 0x72, 0x65,
-	0x76, 0x4c, 0x6f, 0x67, 0x54, 0x65, 0x72, 0x6d, 0x18, 0x03, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0b,
-	0x70, 0x72, 0x65, 0x76, 0x4c, 0x6f, 0x67, 0x54, 0x65, 0x72, 0x6d, 0x12, 0x34, 0x0a, 0x07, 0x65,
-	0x6e, 0x74, 0x72, 0x69, 0x65, 0x73, 0x18, 0x04, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x73,
-	0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x55, 0x70, 0x64, 0x61, 0x74, 0x65, 0x4f,
-	0x70, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x07, 0x65, 0x6e, 0x74, 0x72, 0x69, 0x65,
-	0x73, 0x12, 0x22, 0x0a, 0x0c, 0x6c, 0x65, 0x61, 0x64, 0x65, 0x72, 0x43, 0x6f, 0x6d, 0x6d, 0x69,
-	0x74, 0x18, 0x05, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0c, 0x6c, 0x65, 0x61, 0x64, 0x65, 0x72, 0x43,
-	0x6f, 0x6d, 0x6d, 0x69, 0x74, 0x22, 0x81, 0x01, 0x0a, 0x11, 0x41, 0x70, 0x70, 0x65, 0x6e, 0x64,
-	0x45, 0x6e, 0x74, 0x72, 0x79, 0x4f, 0x75, 0x74, 0x70, 0x75, 0x74, 0x12, 0x1a, 0x0a, 0x08, 0x73,
-	0x65, 0x72, 0x76, 0x65, 0x72, 0x49, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x03, 0x52, 0x08, 0x73,
-	0x65, 0x72, 0x76, 0x65, 0x72, 0x49, 0x64, 0x12, 0x12, 0x0a, 0x04, 0x74, 0x65, 0x72, 0x6d, 0x18,
-	0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x04, 0x74, 0x65, 0x72, 0x6d, 0x12, 0x18, 0x0a, 0x07, 0x73,
-	0x75, 0x63, 0x63, 0x65, 0x73, 0x73, 0x18, 0x03, 0x20, 0x01, 0x28, 0x08, 0x52, 0x07, 0x73, 0x75,
-	0x63, 0x63, 0x65, 0x73, 0x73, 0x12, 0x22, 0x0a, 0x0c, 0x6d, 0x61, 0x74, 0x63, 0x68, 0x65, 0x64,
-	0x49, 0x6e, 0x64, 0x65, 0x78, 0x18, 0x04, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0c, 0x6d, 0x61, 0x74,
-	0x63, 0x68, 0x65, 0x64, 0x49, 0x6e, 0x64, 0x65, 0x78, 0x22, 0x62, 0x0a, 0x0f, 0x55, 0x70, 0x64,
-	0x61, 0x74, 0x65, 0x4f, 0x70, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x12, 0x0a, 0x04,
-	0x74, 0x65, 0x72, 0x6d, 0x18, 0x01, 0x20, 0x01, 0x28, 0x03, 0x52, 0x04, 0x74, 0x65, 0x72, 0x6d,
-	0x12, 0x3b, 0x0a, 0x0c, 0x66, 0x69, 0x6c, 0x65, 0x4d, 0x65, 0x74, 0x61, 0x44, 0x61, 0x74, 0x61,
-	0x18, 0x03, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x17, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f,
-	0x72, 0x65, 0x2e, 0x46, 0x69, 0x6c, 0x65, 0x4d, 0x65, 0x74, 0x61, 0x44, 0x61, 0x74, 0x61, 0x52,
-	0x0c, 0x66, 0x69, 0x6c, 0x65, 0x4d, 0x65, 0x74, 0x61, 0x44, 0x61, 0x74, 0x61, 0x22, 0xa3, 0x01,
-	0x0a, 0x11, 0x52, 0x61, 0x66, 0x74, 0x49, 0x6e, 0x74, 0x65, 0x72, 0x6e, 0x61, 0x6c, 0x53, 0x74,
-	0x61, 0x74, 0x65, 0x12, 0x1a, 0x0a, 0x08, 0x69, 0x73, 0x4c, 0x65, 0x61, 0x64, 0x65, 0x72, 0x18,
-	0x01, 0x20, 0x01, 0x28, 0x08, 0x52, 0x08, 0x69, 0x73, 0x4c, 0x65, 0x61, 0x64, 0x65, 0x72, 0x12,
-	0x12, 0x0a, 0x04, 0x74, 0x65, 0x72, 0x6d, 0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x04, 0x74,
-	0x65, 0x72, 0x6d, 0x12, 0x2c, 0x0a, 0x03, 0x6c, 0x6f, 0x67, 0x18, 0x03, 0x20, 0x03, 0x28, 0x0b,
-	0x32, 0x1a, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x55, 0x70, 0x64,
-	0x61, 0x74, 0x65, 0x4f, 0x70, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x03, 0x6c, 0x6f,
-	0x67, 0x12, 0x30, 0x0a, 0x07, 0x6d, 0x65, 0x74, 0x61, 0x4d, 0x61, 0x70, 0x18, 0x04, 0x20, 0x01,
-	0x28, 0x0b, 0x32, 0x16, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x46,
-	0x69, 0x6c, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x4d, 0x61, 0x70, 0x52, 0x07, 0x6d, 0x65, 0x74, 0x61,
-	0x4d, 0x61, 0x70, 0x32, 0xb5, 0x01, 0x0a, 0x0a, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f,
-	0x72, 0x65, 0x12, 0x34, 0x0a, 0x08, 0x47, 0x65, 0x74, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x12, 0x14,
-	0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c, 0x6f, 0x63, 0x6b,
-	0x48, 0x61, 0x73, 0x68, 0x1a, 0x10, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65,
-	0x2e, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x22, 0x00, 0x12, 0x32, 0x0a, 0x08, 0x50, 0x75, 0x74, 0x42,
-	0x6c, 0x6f, 0x63, 0x6b, 0x12, 0x10, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65,
-	0x2e, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x1a, 0x12, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f,
-	0x72, 0x65, 0x2e, 0x53, 0x75, 0x63, 0x63, 0x65, 0x73, 0x73, 0x22, 0x00, 0x12, 0x3d, 0x0a, 0x09,
-	0x48, 0x61, 0x73, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x73, 0x12, 0x16, 0x2e, 0x73, 0x75, 0x72, 0x66,
-	0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x48, 0x61, 0x73, 0x68, 0x65,
-	0x73, 0x1a, 0x16, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c,
-	0x6f, 0x63, 0x6b, 0x48, 0x61, 0x73, 0x68, 0x65, 0x73, 0x22, 0x00, 0x32, 0xd6, 0x01, 0x0a, 0x09,
-	0x4d, 0x65, 0x74, 0x61, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x12, 0x42, 0x0a, 0x0e, 0x47, 0x65, 0x74,
-	0x46, 0x69, 0x6c, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x4d, 0x61, 0x70, 0x12, 0x16, 0x2e, 0x67, 0x6f,
-	0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x45, 0x6d,
-	0x70, 0x74, 0x79, 0x1a, 0x16, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e,
-	0x46, 0x69, 0x6c, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x4d, 0x61, 0x70, 0x22, 0x00, 0x12, 0x3b, 0x0a,
-	0x0a, 0x55, 0x70, 0x64, 0x61, 0x74, 0x65, 0x46, 0x69, 0x6c, 0x65, 0x12, 0x17, 0x2e, 0x73, 0x75,
-	0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x46, 0x69, 0x6c, 0x65, 0x4d, 0x65, 0x74, 0x61,
-	0x44, 0x61, 0x74, 0x61, 0x1a, 0x12, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65,
-	0x2e, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x22, 0x00, 0x12, 0x48, 0x0a, 0x11, 0x47, 0x65,
-	0x74, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x41, 0x64, 0x64, 0x72, 0x12,
-	0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75,
-	0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79, 0x1a, 0x19, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74,
-	0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x41, 0x64,
-	0x64, 0x72, 0x22, 0x00, 0x32, 0x9e, 0x05, 0x0a, 0x0d, 0x52, 0x61, 0x66, 0x74, 0x53, 0x75, 0x72,
-	0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x12, 0x4c, 0x0a, 0x0d, 0x41, 0x70, 0x70, 0x65, 0x6e, 0x64,
-	0x45, 0x6e, 0x74, 0x72, 0x69, 0x65, 0x73, 0x12, 0x1b, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74,
-	0x6f, 0x72, 0x65, 0x2e, 0x41, 0x70, 0x70, 0x65, 0x6e, 0x64, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x49,
-	0x6e, 0x70, 0x75, 0x74, 0x1a, 0x1c, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65,
-	0x2e, 0x41, 0x70, 0x70, 0x65, 0x6e, 0x64, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x4f, 0x75, 0x74, 0x70,
-	0x75, 0x74, 0x22, 0x00, 0x12, 0x39, 0x0a, 0x09, 0x53, 0x65, 0x74, 0x4c, 0x65, 0x61, 0x64, 0x65,
-	0x72, 0x12, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f,
-	0x62, 0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79, 0x1a, 0x12, 0x2e, 0x73, 0x75, 0x72, 0x66,
-	0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x53, 0x75, 0x63, 0x63, 0x65, 0x73, 0x73, 0x22, 0x00, 0x12,
-	0x3d, 0x0a, 0x0d, 0x53, 0x65, 0x6e, 0x64, 0x48, 0x65, 0x61, 0x72, 0x74, 0x62, 0x65, 0x61, 0x74,
-	0x12, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62,
-	0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79, 0x1a, 0x12, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73,
-	0x74, 0x6f, 0x72, 0x65, 0x2e, 0x53, 0x75, 0x63, 0x63, 0x65, 0x73, 0x73, 0x22, 0x00, 0x12, 0x42,
-	0x0a, 0x0e, 0x47, 0x65, 0x74, 0x46, 0x69, 0x6c, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x4d, 0x61, 0x70,
-	0x12, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62,
-	0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79, 0x1a, 0x16, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73,
+	0x79, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x1a, 0x13, 0x70, 0x6b, 0x67, 0x2f, 0x72, 0x61, 0x66,
+	0x74, 0x2f, 0x52, 0x61, 0x66, 0x74, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0x1f, 0x0a, 0x09,
+	0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x48, 0x61, 0x73, 0x68, 0x12, 0x12, 0x0a, 0x04, 0x68, 0x61, 0x73,
+	0x68, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x68, 0x61, 0x73, 0x68, 0x22, 0x25, 0x0a,
+	0x0b, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x48, 0x61, 0x73, 0x68, 0x65, 0x73, 0x12, 0x16, 0x0a, 0x06,
+	0x68, 0x61, 0x73, 0x68, 0x65, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x09, 0x52, 0x06, 0x68, 0x61,
+	0x73, 0x68, 0x65, 0x73, 0x22, 0x43, 0x0a, 0x05, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x12, 0x1c, 0x0a,
+	0x09, 0x62, 0x6c, 0x6f, 0x63, 0x6b, 0x44, 0x61, 0x74, 0x61, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c,
+	0x52, 0x09, 0x62, 0x6c, 0x6f, 0x63, 0x6b, 0x44, 0x61, 0x74, 0x61, 0x12, 0x1c, 0x0a, 0x09, 0x62,
+	0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x69, 0x7a, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x05, 0x52, 0x09,
+	0x62, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x69, 0x7a, 0x65, 0x22, 0x1d, 0x0a, 0x07, 0x53, 0x75, 0x63,
+	0x63, 0x65, 0x73, 0x73, 0x12, 0x12, 0x0a, 0x04, 0x66, 0x6c, 0x61, 0x67, 0x18, 0x01, 0x20, 0x01,
+	0x28, 0x08, 0x52, 0x04, 0x66, 0x6c, 0x61, 0x67, 0x22, 0xa8, 0x01, 0x0a, 0x0c, 0x46, 0x69, 0x6c,
+	0x65, 0x4d, 0x65, 0x74, 0x61, 0x44, 0x61, 0x74, 0x61, 0x12, 0x1a, 0x0a, 0x08, 0x66, 0x69, 0x6c,
+	0x65, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x66, 0x69, 0x6c,
+	0x65, 0x6e, 0x61, 0x6d, 0x65, 0x12, 0x18, 0x0a, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e,
+	0x18, 0x02, 0x20, 0x01, 0x28, 0x05, 0x52, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12,
+	0x24, 0x0a, 0x0d, 0x62, 0x6c, 0x6f, 0x63, 0x6b, 0x48, 0x61, 0x73, 0x68, 0x4c, 0x69, 0x73, 0x74,
+	0x18, 0x03, 0x20, 0x03, 0x28, 0x09, 0x52, 0x0d, 0x62, 0x6c, 0x6f, 0x63, 0x6b, 0x48, 0x61, 0x73,
+	0x68, 0x4c, 0x69, 0x73, 0x74, 0x12, 0x1a, 0x0a, 0x08, 0x63, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x49,
+	0x64, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x63, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x49,
+	0x64, 0x12, 0x20, 0x0a, 0x0b, 0x73, 0x65, 0x71, 0x75, 0x65, 0x6e, 0x63, 0x65, 0x4e, 0x75, 0x6d,
+	0x18, 0x05, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0b, 0x73, 0x65, 0x71, 0x75, 0x65, 0x6e, 0x63, 0x65,
+	0x4e, 0x75, 0x6d, 0x22, 0xb1, 0x01, 0x0a, 0x0b, 0x46, 0x69, 0x6c, 0x65, 0x49, 0x6e, 0x66, 0x6f,
+	0x4d, 0x61, 0x70, 0x12, 0x49, 0x0a, 0x0b, 0x66, 0x69, 0x6c, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x4d,
+	0x61, 0x70, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x27, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73,
 	0x74, 0x6f, 0x72, 0x65, 0x2e, 0x46, 0x69, 0x6c, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x4d, 0x61, 0x70,
-	0x22, 0x00, 0x12, 0x3b, 0x0a, 0x0a, 0x55, 0x70, 0x64, 0x61, 0x74, 0x65, 0x46, 0x69, 0x6c, 0x65,
-	0x12, 0x17, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x46, 0x69, 0x6c,
-	0x65, 0x4d, 0x65, 0x74, 0x61, 0x44, 0x61, 0x74, 0x61, 0x1a, 0x12, 0x2e, 0x73, 0x75, 0x72, 0x66,
-	0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x22, 0x00, 0x12,
-	0x48, 0x0a, 0x11, 0x47, 0x65, 0x74, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65,
-	0x41, 0x64, 0x64, 0x72, 0x12, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72,
-	0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79, 0x1a, 0x19, 0x2e, 0x73,
-	0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74,
-	0x6f, 0x72, 0x65, 0x41, 0x64, 0x64, 0x72, 0x22, 0x00, 0x12, 0x4a, 0x0a, 0x10, 0x47, 0x65, 0x74,
-	0x49, 0x6e, 0x74, 0x65, 0x72, 0x6e, 0x61, 0x6c, 0x53, 0x74, 0x61, 0x74, 0x65, 0x12, 0x16, 0x2e,
+	0x2e, 0x46, 0x69, 0x6c, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x4d, 0x61, 0x70, 0x45, 0x6e, 0x74, 0x72,
+	0x79, 0x52, 0x0b, 0x66, 0x69, 0x6c, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x4d, 0x61, 0x70, 0x1a, 0x57,
+	0x0a, 0x10, 0x46, 0x69, 0x6c, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x4d, 0x61, 0x70, 0x45, 0x6e, 0x74,
+	0x72, 0x79, 0x12, 0x10, 0x0a, 0x03, 0x6b, 0x65, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x03, 0x6b, 0x65, 0x79, 0x12, 0x2d, 0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x02, 0x20,
+	0x01, 0x28, 0x0b, 0x32, 0x17, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e,
+	0x46, 0x69, 0x6c, 0x65, 0x4d, 0x65, 0x74, 0x61, 0x44, 0x61, 0x74, 0x61, 0x52, 0x05, 0x76, 0x61,
+	0x6c, 0x75, 0x65, 0x3a, 0x02, 0x38, 0x01, 0x22, 0x23, 0x0a, 0x07, 0x56, 0x65, 0x72, 0x73, 0x69,
+	0x6f, 0x6e, 0x12, 0x18, 0x0a, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x01, 0x20,
+	0x01, 0x28, 0x05, 0x52, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x22, 0x24, 0x0a, 0x0e,
+	0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x41, 0x64, 0x64, 0x72, 0x12, 0x12,
+	0x0a, 0x04, 0x61, 0x64, 0x64, 0x72, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x61, 0x64,
+	0x64, 0x72, 0x22, 0x2c, 0x0a, 0x0c, 0x43, 0x72, 0x61, 0x73, 0x68, 0x65, 0x64, 0x53, 0x74, 0x61,
+	0x74, 0x65, 0x12, 0x1c, 0x0a, 0x09, 0x69, 0x73, 0x43, 0x72, 0x61, 0x73, 0x68, 0x65, 0x64, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x08, 0x52, 0x09, 0x69, 0x73, 0x43, 0x72, 0x61, 0x73, 0x68, 0x65, 0x64,
+	0x22, 0x74, 0x0a, 0x0c, 0x4e, 0x65, 0x74, 0x77, 0x6f, 0x72, 0x6b, 0x46, 0x61, 0x75, 0x6c, 0x74,
+	0x12, 0x12, 0x0a, 0x04, 0x61, 0x64, 0x64, 0x72, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04,
+	0x61, 0x64, 0x64, 0x72, 0x12, 0x1a, 0x0a, 0x08, 0x64, 0x72, 0x6f, 0x70, 0x52, 0x61, 0x74, 0x65,
+	0x18, 0x02, 0x20, 0x01, 0x28, 0x01, 0x52, 0x08, 0x64, 0x72, 0x6f, 0x70, 0x52, 0x61, 0x74, 0x65,
+	0x12, 0x18, 0x0a, 0x07, 0x64, 0x65, 0x6c, 0x61, 0x79, 0x4d, 0x73, 0x18, 0x03, 0x20, 0x01, 0x28,
+	0x03, 0x52, 0x07, 0x64, 0x65, 0x6c, 0x61, 0x79, 0x4d, 0x73, 0x12, 0x1a, 0x0a, 0x08, 0x6a, 0x69,
+	0x74, 0x74, 0x65, 0x72, 0x4d, 0x73, 0x18, 0x04, 0x20, 0x01, 0x28, 0x03, 0x52, 0x08, 0x6a, 0x69,
+	0x74, 0x74, 0x65, 0x72, 0x4d, 0x73, 0x22, 0x87, 0x01, 0x0a, 0x11, 0x4d, 0x65, 0x74, 0x61, 0x53,
+	0x74, 0x6f, 0x72, 0x65, 0x53, 0x6e, 0x61, 0x70, 0x73, 0x68, 0x6f, 0x74, 0x12, 0x30, 0x0a, 0x07,
+	0x6d, 0x65, 0x74, 0x61, 0x4d, 0x61, 0x70, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x16, 0x2e,
+	0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x46, 0x69, 0x6c, 0x65, 0x49, 0x6e,
+	0x66, 0x6f, 0x4d, 0x61, 0x70, 0x52, 0x07, 0x6d, 0x65, 0x74, 0x61, 0x4d, 0x61, 0x70, 0x12, 0x40,
+	0x0a, 0x0e, 0x63, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x53, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x73,
+	0x18, 0x02, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x18, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f,
+	0x72, 0x65, 0x2e, 0x43, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x53, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e,
+	0x52, 0x0e, 0x63, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x53, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x73,
+	0x22, 0x7d, 0x0a, 0x0d, 0x43, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x53, 0x65, 0x73, 0x73, 0x69, 0x6f,
+	0x6e, 0x12, 0x1a, 0x0a, 0x08, 0x63, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x49, 0x64, 0x18, 0x01, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x08, 0x63, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x49, 0x64, 0x12, 0x20, 0x0a,
+	0x0b, 0x73, 0x65, 0x71, 0x75, 0x65, 0x6e, 0x63, 0x65, 0x4e, 0x75, 0x6d, 0x18, 0x02, 0x20, 0x01,
+	0x28, 0x03, 0x52, 0x0b, 0x73, 0x65, 0x71, 0x75, 0x65, 0x6e, 0x63, 0x65, 0x4e, 0x75, 0x6d, 0x12,
+	0x18, 0x0a, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x03, 0x20, 0x01, 0x28, 0x05,
+	0x52, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x14, 0x0a, 0x05, 0x65, 0x72, 0x72,
+	0x6f, 0x72, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x22,
+	0x9d, 0x01, 0x0a, 0x0f, 0x55, 0x70, 0x64, 0x61, 0x74, 0x65, 0x4f, 0x70, 0x65, 0x72, 0x61, 0x74,
+	0x69, 0x6f, 0x6e, 0x12, 0x12, 0x0a, 0x04, 0x74, 0x65, 0x72, 0x6d, 0x18, 0x01, 0x20, 0x01, 0x28,
+	0x03, 0x52, 0x04, 0x74, 0x65, 0x72, 0x6d, 0x12, 0x3b, 0x0a, 0x0c, 0x66, 0x69, 0x6c, 0x65, 0x4d,
+	0x65, 0x74, 0x61, 0x44, 0x61, 0x74, 0x61, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x17, 0x2e,
+	0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x46, 0x69, 0x6c, 0x65, 0x4d, 0x65,
+	0x74, 0x61, 0x44, 0x61, 0x74, 0x61, 0x52, 0x0c, 0x66, 0x69, 0x6c, 0x65, 0x4d, 0x65, 0x74, 0x61,
+	0x44, 0x61, 0x74, 0x61, 0x12, 0x39, 0x0a, 0x0d, 0x63, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x75, 0x72,
+	0x61, 0x74, 0x69, 0x6f, 0x6e, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x13, 0x2e, 0x72, 0x61,
+	0x66, 0x74, 0x2e, 0x43, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x75, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e,
+	0x52, 0x0d, 0x63, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x75, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x22,
+	0xde, 0x01, 0x0a, 0x11, 0x52, 0x61, 0x66, 0x74, 0x49, 0x6e, 0x74, 0x65, 0x72, 0x6e, 0x61, 0x6c,
+	0x53, 0x74, 0x61, 0x74, 0x65, 0x12, 0x1a, 0x0a, 0x08, 0x69, 0x73, 0x4c, 0x65, 0x61, 0x64, 0x65,
+	0x72, 0x18, 0x01, 0x20, 0x01, 0x28, 0x08, 0x52, 0x08, 0x69, 0x73, 0x4c, 0x65, 0x61, 0x64, 0x65,
+	0x72, 0x12, 0x12, 0x0a, 0x04, 0x74, 0x65, 0x72, 0x6d, 0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52,
+	0x04, 0x74, 0x65, 0x72, 0x6d, 0x12, 0x2c, 0x0a, 0x03, 0x6c, 0x6f, 0x67, 0x18, 0x03, 0x20, 0x03,
+	0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x55,
+	0x70, 0x64, 0x61, 0x74, 0x65, 0x4f, 0x70, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x03,
+	0x6c, 0x6f, 0x67, 0x12, 0x30, 0x0a, 0x07, 0x6d, 0x65, 0x74, 0x61, 0x4d, 0x61, 0x70, 0x18, 0x04,
+	0x20, 0x01, 0x28, 0x0b, 0x32, 0x16, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65,
+	0x2e, 0x46, 0x69, 0x6c, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x4d, 0x61, 0x70, 0x52, 0x07, 0x6d, 0x65,
+	0x74, 0x61, 0x4d, 0x61, 0x70, 0x12, 0x39, 0x0a, 0x0d, 0x63, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x75,
+	0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x13, 0x2e, 0x72,
+	0x61, 0x66, 0x74, 0x2e, 0x43, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x75, 0x72, 0x61, 0x74, 0x69, 0x6f,
+	0x6e, 0x52, 0x0d, 0x63, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x75, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e,
+	0x32, 0xb5, 0x01, 0x0a, 0x0a, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x12,
+	0x34, 0x0a, 0x08, 0x47, 0x65, 0x74, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x12, 0x14, 0x2e, 0x73, 0x75,
+	0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x48, 0x61, 0x73,
+	0x68, 0x1a, 0x10, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c,
+	0x6f, 0x63, 0x6b, 0x22, 0x00, 0x12, 0x32, 0x0a, 0x08, 0x50, 0x75, 0x74, 0x42, 0x6c, 0x6f, 0x63,
+	0x6b, 0x12, 0x10, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c,
+	0x6f, 0x63, 0x6b, 0x1a, 0x12, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e,
+	0x53, 0x75, 0x63, 0x63, 0x65, 0x73, 0x73, 0x22, 0x00, 0x12, 0x3d, 0x0a, 0x09, 0x48, 0x61, 0x73,
+	0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x73, 0x12, 0x16, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f,
+	0x72, 0x65, 0x2e, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x48, 0x61, 0x73, 0x68, 0x65, 0x73, 0x1a, 0x16,
+	0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c, 0x6f, 0x63, 0x6b,
+	0x48, 0x61, 0x73, 0x68, 0x65, 0x73, 0x22, 0x00, 0x32, 0xd6, 0x01, 0x0a, 0x09, 0x4d, 0x65, 0x74,
+	0x61, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x12, 0x42, 0x0a, 0x0e, 0x47, 0x65, 0x74, 0x46, 0x69, 0x6c,
+	0x65, 0x49, 0x6e, 0x66, 0x6f, 0x4d, 0x61, 0x70, 0x12, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c,
+	0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79,
+	0x1a, 0x16, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x46, 0x69, 0x6c,
+	0x65, 0x49, 0x6e, 0x66, 0x6f, 0x4d, 0x61, 0x70, 0x22, 0x00, 0x12, 0x3b, 0x0a, 0x0a, 0x55, 0x70,
+	0x64, 0x61, 0x74, 0x65, 0x46, 0x69, 0x6c, 0x65, 0x12, 0x17, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73,
+	0x74, 0x6f, 0x72, 0x65, 0x2e, 0x46, 0x69, 0x6c, 0x65, 0x4d, 0x65, 0x74, 0x61, 0x44, 0x61, 0x74,
+	0x61, 0x1a, 0x12, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x56, 0x65,
+	0x72, 0x73, 0x69, 0x6f, 0x6e, 0x22, 0x00, 0x12, 0x48, 0x0a, 0x11, 0x47, 0x65, 0x74, 0x42, 0x6c,
+	0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x41, 0x64, 0x64, 0x72, 0x12, 0x16, 0x2e, 0x67,
+	0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x45,
+	0x6d, 0x70, 0x74, 0x79, 0x1a, 0x19, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65,
+	0x2e, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x41, 0x64, 0x64, 0x72, 0x22,
+	0x00, 0x32, 0x8d, 0x08, 0x0a, 0x0d, 0x52, 0x61, 0x66, 0x74, 0x53, 0x75, 0x72, 0x66, 0x73, 0x74,
+	0x6f, 0x72, 0x65, 0x12, 0x37, 0x0a, 0x09, 0x41, 0x64, 0x64, 0x53, 0x65, 0x72, 0x76, 0x65, 0x72,
+	0x12, 0x13, 0x2e, 0x72, 0x61, 0x66, 0x74, 0x2e, 0x43, 0x6c, 0x75, 0x73, 0x74, 0x65, 0x72, 0x4d,
+	0x65, 0x6d, 0x62, 0x65, 0x72, 0x1a, 0x13, 0x2e, 0x72, 0x61, 0x66, 0x74, 0x2e, 0x43, 0x6f, 0x6e,
+	0x66, 0x69, 0x67, 0x75, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x22, 0x00, 0x12, 0x3a, 0x0a, 0x0c,
+	0x52, 0x65, 0x6d, 0x6f, 0x76, 0x65, 0x53, 0x65, 0x72, 0x76, 0x65, 0x72, 0x12, 0x13, 0x2e, 0x72,
+	0x61, 0x66, 0x74, 0x2e, 0x43, 0x6c, 0x75, 0x73, 0x74, 0x65, 0x72, 0x4d, 0x65, 0x6d, 0x62, 0x65,
+	0x72, 0x1a, 0x13, 0x2e, 0x72, 0x61, 0x66, 0x74, 0x2e, 0x43, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x75,
+	0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x22, 0x00, 0x12, 0x3c, 0x0a, 0x0e, 0x50, 0x72, 0x6f, 0x6d,
+	0x6f, 0x74, 0x65, 0x4c, 0x65, 0x61, 0x72, 0x6e, 0x65, 0x72, 0x12, 0x13, 0x2e, 0x72, 0x61, 0x66,
+	0x74, 0x2e, 0x43, 0x6c, 0x75, 0x73, 0x74, 0x65, 0x72, 0x4d, 0x65, 0x6d, 0x62, 0x65, 0x72, 0x1a,
+	0x13, 0x2e, 0x72, 0x61, 0x66, 0x74, 0x2e, 0x43, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x75, 0x72, 0x61,
+	0x74, 0x69, 0x6f, 0x6e, 0x22, 0x00, 0x12, 0x3f, 0x0a, 0x12, 0x54, 0x72, 0x61, 0x6e, 0x73, 0x66,
+	0x65, 0x72, 0x4c, 0x65, 0x61, 0x64, 0x65, 0x72, 0x73, 0x68, 0x69, 0x70, 0x12, 0x13, 0x2e, 0x72,
+	0x61, 0x66, 0x74, 0x2e, 0x43, 0x6c, 0x75, 0x73, 0x74, 0x65, 0x72, 0x4d, 0x65, 0x6d, 0x62, 0x65,
+	0x72, 0x1a, 0x12, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x53, 0x75,
+	0x63, 0x63, 0x65, 0x73, 0x73, 0x22, 0x00, 0x12, 0x39, 0x0a, 0x09, 0x53, 0x65, 0x74, 0x4c, 0x65,
+	0x61, 0x64, 0x65, 0x72, 0x12, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72,
+	0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79, 0x1a, 0x12, 0x2e, 0x73,
+	0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x53, 0x75, 0x63, 0x63, 0x65, 0x73, 0x73,
+	0x22, 0x00, 0x12, 0x3d, 0x0a, 0x0d, 0x53, 0x65, 0x6e, 0x64, 0x48, 0x65, 0x61, 0x72, 0x74, 0x62,
+	0x65, 0x61, 0x74, 0x12, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f,
+	0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79, 0x1a, 0x12, 0x2e, 0x73, 0x75,
+	0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x53, 0x75, 0x63, 0x63, 0x65, 0x73, 0x73, 0x22,
+	0x00, 0x12, 0x41, 0x0a, 0x10, 0x47, 0x65, 0x74, 0x43, 0x6c, 0x75, 0x73, 0x74, 0x65, 0x72, 0x53,
+	0x74, 0x61, 0x74, 0x75, 0x73, 0x12, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70,
+	0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79, 0x1a, 0x13, 0x2e,
+	0x72, 0x61, 0x66, 0x74, 0x2e, 0x43, 0x6c, 0x75, 0x73, 0x74, 0x65, 0x72, 0x53, 0x74, 0x61, 0x74,
+	0x75, 0x73, 0x22, 0x00, 0x12, 0x42, 0x0a, 0x0e, 0x47, 0x65, 0x74, 0x46, 0x69, 0x6c, 0x65, 0x49,
+	0x6e, 0x66, 0x6f, 0x4d, 0x61, 0x70, 0x12, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e,
+	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79, 0x1a, 0x16,
+	0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x46, 0x69, 0x6c, 0x65, 0x49,
+	0x6e, 0x66, 0x6f, 0x4d, 0x61, 0x70, 0x22, 0x00, 0x12, 0x3b, 0x0a, 0x0a, 0x55, 0x70, 0x64, 0x61,
+	0x74, 0x65, 0x46, 0x69, 0x6c, 0x65, 0x12, 0x17, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f,
+	0x72, 0x65, 0x2e, 0x46, 0x69, 0x6c, 0x65, 0x4d, 0x65, 0x74, 0x61, 0x44, 0x61, 0x74, 0x61, 0x1a,
+	0x12, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x56, 0x65, 0x72, 0x73,
+	0x69, 0x6f, 0x6e, 0x22, 0x00, 0x12, 0x48, 0x0a, 0x11, 0x47, 0x65, 0x74, 0x42, 0x6c, 0x6f, 0x63,
+	0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x41, 0x64, 0x64, 0x72, 0x12, 0x16, 0x2e, 0x67, 0x6f, 0x6f,
+	0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70,
+	0x74, 0x79, 0x1a, 0x19, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42,
+	0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x41, 0x64, 0x64, 0x72, 0x22, 0x00, 0x12,
+	0x4a, 0x0a, 0x10, 0x47, 0x65, 0x74, 0x49, 0x6e, 0x74, 0x65, 0x72, 0x6e, 0x61, 0x6c, 0x53, 0x74,
+	0x61, 0x74, 0x65, 0x12, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f,
+	0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79, 0x1a, 0x1c, 0x2e, 0x73, 0x75,
+	0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x52, 0x61, 0x66, 0x74, 0x49, 0x6e, 0x74, 0x65,
+	0x72, 0x6e, 0x61, 0x6c, 0x53, 0x74, 0x61, 0x74, 0x65, 0x22, 0x00, 0x12, 0x3e, 0x0a, 0x09, 0x49,
+	0x73, 0x43, 0x72, 0x61, 0x73, 0x68, 0x65, 0x64, 0x12, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c,
+	0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79,
+	0x1a, 0x17, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x43, 0x72, 0x61,
+	0x73, 0x68, 0x65, 0x64, 0x53, 0x74, 0x61, 0x74, 0x65, 0x22, 0x00, 0x12, 0x37, 0x0a, 0x07, 0x52,
+	0x65, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x12, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e,
+	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79, 0x1a, 0x12,
+	0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x53, 0x75, 0x63, 0x63, 0x65,
+	0x73, 0x73, 0x22, 0x00, 0x12, 0x35, 0x0a, 0x05, 0x43, 0x72, 0x61, 0x73, 0x68, 0x12, 0x16, 0x2e,
 	0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e,
-	0x45, 0x6d, 0x70, 0x74, 0x79, 0x1a, 0x1c, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72,
-	0x65, 0x2e, 0x52, 0x61, 0x66, 0x74, 0x49, 0x6e, 0x74, 0x65, 0x72, 0x6e, 0x61, 0x6c, 0x53, 0x74,
-	0x61, 0x74, 0x65, 0x22, 0x00, 0x12, 0x3e, 0x0a, 0x09, 0x49, 0x73, 0x43, 0x72, 0x61, 0x73, 0x68,
-	0x65, 0x64, 0x12, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74,
-	0x6f, 0x62, 0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79, 0x1a, 0x17, 0x2e, 0x73, 0x75, 0x72,
-	0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x43, 0x72, 0x61, 0x73, 0x68, 0x65, 0x64, 0x53, 0x74,
-	0x61, 0x74, 0x65, 0x22, 0x00, 0x12, 0x37, 0x0a, 0x07, 0x52, 0x65, 0x73, 0x74, 0x6f, 0x72, 0x65,
-	0x12, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62,
-	0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79, 0x1a, 0x12, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73,
-	0x74, 0x6f, 0x72, 0x65, 0x2e, 0x53, 0x75, 0x63, 0x63, 0x65, 0x73, 0x73, 0x22, 0x00, 0x12, 0x35,
-	0x0a, 0x05, 0x43, 0x72, 0x61, 0x73, 0x68, 0x12, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65,
-	0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79, 0x1a,
-	0x12, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x53, 0x75, 0x63, 0x63,
-	0x65, 0x73, 0x73, 0x22, 0x00, 0x42, 0x1c, 0x5a, 0x1a, 0x63, 0x73, 0x65, 0x32, 0x32, 0x34, 0x2f,
-	0x70, 0x72, 0x6f, 0x6a, 0x35, 0x2f, 0x70, 0x6b, 0x67, 0x2f, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74,
-	0x6f, 0x72, 0x65, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x45, 0x6d, 0x70, 0x74, 0x79, 0x1a, 0x12, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72,
+	0x65, 0x2e, 0x53, 0x75, 0x63, 0x63, 0x65, 0x73, 0x73, 0x22, 0x00, 0x12, 0x40, 0x0a, 0x0f, 0x53,
+	0x65, 0x74, 0x4e, 0x65, 0x74, 0x77, 0x6f, 0x72, 0x6b, 0x46, 0x61, 0x75, 0x6c, 0x74, 0x12, 0x17,
+	0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x4e, 0x65, 0x74, 0x77, 0x6f,
+	0x72, 0x6b, 0x46, 0x61, 0x75, 0x6c, 0x74, 0x1a, 0x12, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74,
+	0x6f, 0x72, 0x65, 0x2e, 0x53, 0x75, 0x63, 0x63, 0x65, 0x73, 0x73, 0x22, 0x00, 0x12, 0x42, 0x0a,
+	0x12, 0x43, 0x6c, 0x65, 0x61, 0x72, 0x4e, 0x65, 0x74, 0x77, 0x6f, 0x72, 0x6b, 0x46, 0x61, 0x75,
+	0x6c, 0x74, 0x73, 0x12, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f,
+	0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79, 0x1a, 0x12, 0x2e, 0x73, 0x75,
+	0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x53, 0x75, 0x63, 0x63, 0x65, 0x73, 0x73, 0x22,
+	0x00, 0x42, 0x1c, 0x5a, 0x1a, 0x63, 0x73, 0x65, 0x32, 0x32, 0x34, 0x2f, 0x70, 0x72, 0x6f, 0x6a,
+	0x35, 0x2f, 0x70, 0x6b, 0x67, 0x2f, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x62,
+	0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -909,68 +1036,87 @@ func file_pkg_surfstore_SurfStore_proto_rawDescGZIP() []byte {
 	return file_pkg_surfstore_SurfStore_proto_rawDescData
 }
 
-var file_pkg_surfstore_SurfStore_proto_msgTypes = make([]protoimpl.MessageInfo, 14)
+var file_pkg_surfstore_SurfStore_proto_msgTypes = make([]protoimpl.MessageInfo, 15)
 var file_pkg_surfstore_SurfStore_proto_goTypes = []interface{}{
-	(*BlockHash)(nil),         // 0: surfstore.BlockHash
-	(*BlockHashes)(nil),       // 1: surfstore.BlockHashes
-	(*Block)(nil),             // 2: surfstore.Block
-	(*Success)(nil),           // 3: surfstore.Success
-	(*FileMetaData)(nil),      // 4: surfstore.FileMetaData
-	(*FileInfoMap)(nil),       // 5: surfstore.FileInfoMap
-	(*Version)(nil),           // 6: surfstore.Version
-	(*BlockStoreAddr)(nil),    // 7: surfstore.BlockStoreAddr
-	(*CrashedState)(nil),      // 8: surfstore.CrashedState
-	(*AppendEntryInput)(nil),  // 9: surfstore.AppendEntryInput
-	(*AppendEntryOutput)(nil), // 10: surfstore.AppendEntryOutput
-	(*UpdateOperation)(nil),   // 11: surfstore.UpdateOperation
-	(*RaftInternalState)(nil), // 12: surfstore.RaftInternalState
-	nil,                       // 13: surfstore.FileInfoMap.FileInfoMapEntry
-	(*emptypb.Empty)(nil),     // 14: google.protobuf.Empty
+	(*BlockHash)(nil),          // 0: surfstore.BlockHash
+	(*BlockHashes)(nil),        // 1: surfstore.BlockHashes
+	(*Block)(nil),              // 2: surfstore.Block
+	(*Success)(nil),            // 3: surfstore.Success
+	(*FileMetaData)(nil),       // 4: surfstore.FileMetaData
+	(*FileInfoMap)(nil),        // 5: surfstore.FileInfoMap
+	(*Version)(nil),            // 6: surfstore.Version
+	(*BlockStoreAddr)(nil),     // 7: surfstore.BlockStoreAddr
+	(*CrashedState)(nil),       // 8: surfstore.CrashedState
+	(*NetworkFault)(nil),       // 9: surfstore.NetworkFault
+	(*MetaStoreSnapshot)(nil),  // 10: surfstore.MetaStoreSnapshot
+	(*ClientSession)(nil),      // 11: surfstore.ClientSession
+	(*UpdateOperation)(nil),    // 12: surfstore.UpdateOperation
+	(*RaftInternalState)(nil),  // 13: surfstore.RaftInternalState
+	nil,                        // 14: surfstore.FileInfoMap.FileInfoMapEntry
+	(*raft.Configuration)(nil), // 15: raft.Configuration
+	(*emptypb.Empty)(nil),      // 16: google.protobuf.Empty
+	(*raft.ClusterMember)(nil), // 17: raft.ClusterMember
+	(*raft.ClusterStatus)(nil), // 18: raft.ClusterStatus
 }
 var file_pkg_surfstore_SurfStore_proto_depIdxs = []int32{
-	13, // 0: surfstore.FileInfoMap.fileInfoMap:type_name -> surfstore.FileInfoMap.FileInfoMapEntry
-	11, // 1: surfstore.AppendEntryInput.entries:type_name -> surfstore.UpdateOperation
-	4,  // 2: surfstore.UpdateOperation.fileMetaData:type_name -> surfstore.FileMetaData
-	11, // 3: surfstore.RaftInternalState.log:type_name -> surfstore.UpdateOperation
-	5,  // 4: surfstore.RaftInternalState.metaMap:type_name -> surfstore.FileInfoMap
-	4,  // 5: surfstore.FileInfoMap.FileInfoMapEntry.value:type_name -> surfstore.FileMetaData
-	0,  // 6: surfstore.BlockStore.GetBlock:input_type -> surfstore.BlockHash
-	2,  // 7: surfstore.BlockStore.PutBlock:input_type -> surfstore.Block
-	1,  // 8: surfstore.BlockStore.HasBlocks:input_type -> surfstore.BlockHashes
-	14, // 9: surfstore.MetaStore.GetFileInfoMap:input_type -> google.protobuf.Empty
-	4,  // 10: surfstore.MetaStore.UpdateFile:input_type -> surfstore.FileMetaData
-	14, // 11: surfstore.MetaStore.GetBlockStoreAddr:input_type -> google.protobuf.Empty
-	9,  // 12: surfstore.RaftSurfstore.AppendEntries:input_type -> surfstore.AppendEntryInput
-	14, // 13: surfstore.RaftSurfstore.SetLeader:input_type -> google.protobuf.Empty
-	14, // 14: surfstore.RaftSurfstore.SendHeartbeat:input_type -> google.protobuf.Empty
-	14, // 15: surfstore.RaftSurfstore.GetFileInfoMap:input_type -> google.protobuf.Empty
-	4,  // 16: surfstore.RaftSurfstore.UpdateFile:input_type -> surfstore.FileMetaData
-	14, // 17: surfstore.RaftSurfstore.GetBlockStoreAddr:input_type -> google.protobuf.Empty
-	14, // 18: surfstore.RaftSurfstore.GetInternalState:input_type -> google.protobuf.Empty
-	14, // 19: surfstore.RaftSurfstore.IsCrashed:input_type -> google.protobuf.Empty
-	14, // 20: surfstore.RaftSurfstore.Restore:input_type -> google.protobuf.Empty
-	14, // 21: surfstore.RaftSurfstore.Crash:input_type -> google.protobuf.Empty
-	2,  // 22: surfstore.BlockStore.GetBlock:output_type -> surfstore.Block
-	3,  // 23: surfstore.BlockStore.PutBlock:output_type -> surfstore.Success
-	1,  // 24: surfstore.BlockStore.HasBlocks:output_type -> surfstore.BlockHashes
-	5,  // 25: surfstore.MetaStore.GetFileInfoMap:output_type -> surfstore.FileInfoMap
-	6,  // 26: surfstore.MetaStore.UpdateFile:output_type -> surfstore.Version
-	7,  // 27: surfstore.MetaStore.GetBlockStoreAddr:output_type -> surfstore.BlockStoreAddr
-	10, // 28: surfstore.RaftSurfstore.AppendEntries:output_type -> surfstore.AppendEntryOutput
-	3,  // 29: surfstore.RaftSurfstore.SetLeader:output_type -> surfstore.Success
-	3,  // 30: surfstore.RaftSurfstore.SendHeartbeat:output_type -> surfstore.Success
-	5,  // 31: surfstore.RaftSurfstore.GetFileInfoMap:output_type -> surfstore.FileInfoMap
-	6,  // 32: surfstore.RaftSurfstore.UpdateFile:output_type -> surfstore.Version
-	7,  // 33: surfstore.RaftSurfstore.GetBlockStoreAddr:output_type -> surfstore.BlockStoreAddr
-	12, // 34: surfstore.RaftSurfstore.GetInternalState:output_type -> surfstore.RaftInternalState
-	8,  // 35: surfstore.RaftSurfstore.IsCrashed:output_type -> surfstore.CrashedState
-	3,  // 36: surfstore.RaftSurfstore.Restore:output_type -> surfstore.Success
-	3,  // 37: surfstore.RaftSurfstore.Crash:output_type -> surfstore.Success
-	22, // [22:38] is the sub-list for method output_type
-	6,  // [6:22] is the sub-list for method input_type
-	6,  // [6:6] is the sub-list for extension type_name
-	6,  // [6:6] is the sub-list for extension extendee
-	0,  // [0:6] is the sub-list for field type_name
+	14, // 0: surfstore.FileInfoMap.fileInfoMap:type_name -> surfstore.FileInfoMap.FileInfoMapEntry
+	5,  // 1: surfstore.MetaStoreSnapshot.metaMap:type_name -> surfstore.FileInfoMap
+	11, // 2: surfstore.MetaStoreSnapshot.clientSessions:type_name -> surfstore.ClientSession
+	4,  // 3: surfstore.UpdateOperation.fileMetaData:type_name -> surfstore.FileMetaData
+	15, // 4: surfstore.UpdateOperation.configuration:type_name -> raft.Configuration
+	12, // 5: surfstore.RaftInternalState.log:type_name -> surfstore.UpdateOperation
+	5,  // 6: surfstore.RaftInternalState.metaMap:type_name -> surfstore.FileInfoMap
+	15, // 7: surfstore.RaftInternalState.configuration:type_name -> raft.Configuration
+	4,  // 8: surfstore.FileInfoMap.FileInfoMapEntry.value:type_name -> surfstore.FileMetaData
+	0,  // 9: surfstore.BlockStore.GetBlock:input_type -> surfstore.BlockHash
+	2,  // 10: surfstore.BlockStore.PutBlock:input_type -> surfstore.Block
+	1,  // 11: surfstore.BlockStore.HasBlocks:input_type -> surfstore.BlockHashes
+	16, // 12: surfstore.MetaStore.GetFileInfoMap:input_type -> google.protobuf.Empty
+	4,  // 13: surfstore.MetaStore.UpdateFile:input_type -> surfstore.FileMetaData
+	16, // 14: surfstore.MetaStore.GetBlockStoreAddr:input_type -> google.protobuf.Empty
+	17, // 15: surfstore.RaftSurfstore.AddServer:input_type -> raft.ClusterMember
+	17, // 16: surfstore.RaftSurfstore.RemoveServer:input_type -> raft.ClusterMember
+	17, // 17: surfstore.RaftSurfstore.PromoteLearner:input_type -> raft.ClusterMember
+	17, // 18: surfstore.RaftSurfstore.TransferLeadership:input_type -> raft.ClusterMember
+	16, // 19: surfstore.RaftSurfstore.SetLeader:input_type -> google.protobuf.Empty
+	16, // 20: surfstore.RaftSurfstore.SendHeartbeat:input_type -> google.protobuf.Empty
+	16, // 21: surfstore.RaftSurfstore.GetClusterStatus:input_type -> google.protobuf.Empty
+	16, // 22: surfstore.RaftSurfstore.GetFileInfoMap:input_type -> google.protobuf.Empty
+	4,  // 23: surfstore.RaftSurfstore.UpdateFile:input_type -> surfstore.FileMetaData
+	16, // 24: surfstore.RaftSurfstore.GetBlockStoreAddr:input_type -> google.protobuf.Empty
+	16, // 25: surfstore.RaftSurfstore.GetInternalState:input_type -> google.protobuf.Empty
+	16, // 26: surfstore.RaftSurfstore.IsCrashed:input_type -> google.protobuf.Empty
+	16, // 27: surfstore.RaftSurfstore.Restore:input_type -> google.protobuf.Empty
+	16, // 28: surfstore.RaftSurfstore.Crash:input_type -> google.protobuf.Empty
+	9,  // 29: surfstore.RaftSurfstore.SetNetworkFault:input_type -> surfstore.NetworkFault
+	16, // 30: surfstore.RaftSurfstore.ClearNetworkFaults:input_type -> google.protobuf.Empty
+	2,  // 31: surfstore.BlockStore.GetBlock:output_type -> surfstore.Block
+	3,  // 32: surfstore.BlockStore.PutBlock:output_type -> surfstore.Success
+	1,  // 33: surfstore.BlockStore.HasBlocks:output_type -> surfstore.BlockHashes
+	5,  // 34: surfstore.MetaStore.GetFileInfoMap:output_type -> surfstore.FileInfoMap
+	6,  // 35: surfstore.MetaStore.UpdateFile:output_type -> surfstore.Version
+	7,  // 36: surfstore.MetaStore.GetBlockStoreAddr:output_type -> surfstore.BlockStoreAddr
+	15, // 37: surfstore.RaftSurfstore.AddServer:output_type -> raft.Configuration
+	15, // 38: surfstore.RaftSurfstore.RemoveServer:output_type -> raft.Configuration
+	15, // 39: surfstore.RaftSurfstore.PromoteLearner:output_type -> raft.Configuration
+	3,  // 40: surfstore.RaftSurfstore.TransferLeadership:output_type -> surfstore.Success
+	3,  // 41: surfstore.RaftSurfstore.SetLeader:output_type -> surfstore.Success
+	3,  // 42: surfstore.RaftSurfstore.SendHeartbeat:output_type -> surfstore.Success
+	18, // 43: surfstore.RaftSurfstore.GetClusterStatus:output_type -> raft.ClusterStatus
+	5,  // 44: surfstore.RaftSurfstore.GetFileInfoMap:output_type -> surfstore.FileInfoMap
+	6,  // 45: surfstore.RaftSurfstore.UpdateFile:output_type -> surfstore.Version
+	7,  // 46: surfstore.RaftSurfstore.GetBlockStoreAddr:output_type -> surfstore.BlockStoreAddr
+	13, // 47: surfstore.RaftSurfstore.GetInternalState:output_type -> surfstore.RaftInternalState
+	8,  // 48: surfstore.RaftSurfstore.IsCrashed:output_type -> surfstore.CrashedState
+	3,  // 49: surfstore.RaftSurfstore.Restore:output_type -> surfstore.Success
+	3,  // 50: surfstore.RaftSurfstore.Crash:output_type -> surfstore.Success
+	3,  // 51: surfstore.RaftSurfstore.SetNetworkFault:output_type -> surfstore.Success
+	3,  // 52: surfstore.RaftSurfstore.ClearNetworkFaults:output_type -> surfstore.Success
+	31, // [31:53] is the sub-list for method output_type
+	9,  // [9:31] is the sub-list for method input_type
+	9,  // [9:9] is the sub-list for extension type_name
+	9,  // [9:9] is the sub-list for extension extendee
+	0,  // [0:9] is the sub-list for field type_name
 }
 
 func init() { file_pkg_surfstore_SurfStore_proto_init() }
@@ -1088,7 +1234,7 @@ func file_pkg_surfstore_SurfStore_proto_init() {
 			}
 		}
 		file_pkg_surfstore_SurfStore_proto_msgTypes[9].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*AppendEntryInput); i {
+			switch v := v.(*NetworkFault); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1100,7 +1246,7 @@ func file_pkg_surfstore_SurfStore_proto_init() {
 			}
 		}
 		file_pkg_surfstore_SurfStore_proto_msgTypes[10].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*AppendEntryOutput); i {
+			switch v := v.(*MetaStoreSnapshot); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1112,7 +1258,7 @@ func file_pkg_surfstore_SurfStore_proto_init() {
 			}
 		}
 		file_pkg_surfstore_SurfStore_proto_msgTypes[11].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*UpdateOperation); i {
+			switch v := v.(*ClientSession); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1124,6 +1270,18 @@ func file_pkg_surfstore_SurfStore_proto_init() {
 			}
 		}
 		file_pkg_surfstore_SurfStore_proto_msgTypes[12].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*UpdateOperation); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_surfstore_SurfStore_proto_msgTypes[13].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*RaftInternalState); i {
 			case 0:
 				return &v.state
@@ -1142,7 +1300,7 @@ func file_pkg_surfstore_SurfStore_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_pkg_surfstore_SurfStore_proto_rawDesc,
 			NumEnums:      0,
-			NumMessages:   14,
+			NumMessages:   15,
 			NumExtensions: 0,
 			NumServices:   3,
 		},
@@ -1,5 +1,10 @@
 package surfstore
 
+import (
+	"errors"
+	"time"
+)
+
 const DEFAULT_META_FILENAME string = "index.txt"
 
 const FILENAME_INDEX int = 0
@@ -8,3 +13,15 @@ const HASH_LIST_INDEX int = 2
 
 const CONFIG_DELIMITER string = ","
 const HASH_DELIMITER string = " "
+
+// Marks a learner in the config file
+const LEARNER_ROLE = "learner"
+
+// How many times the client tries every MetaStore address before giving up
+// on finding a leader, and how long it waits while an election is running
+const LEADER_SEARCH_ROUNDS int = 3
+const LEADER_RETRY_INTERVAL = 200 * time.Millisecond
+
+// An UpdateFile older than the last one applied for its client, the client
+// stopped waiting for it long ago
+var ERR_STALE_REQUEST = errors.New("Request is older than the last one applied for this client")
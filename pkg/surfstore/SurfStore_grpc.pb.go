@@ -4,6 +4,7 @@ package surfstore
 
 import (
 	context "context"
+	raft "cse224/proj5/pkg/raft"
 	grpc "google.golang.org/grpc"
 	codes "google.golang.org/grpc/codes"
 	status "google.golang.org/grpc/status"
@@ -335,10 +336,14 @@ var MetaStore_ServiceDesc = grpc.ServiceDesc{
 //
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type RaftSurfstoreClient interface {
-	// raft
-	AppendEntries(ctx context.Context, in *AppendEntryInput, opts ...grpc.CallOption) (*AppendEntryOutput, error)
+	// raft, the RPCs between servers are in the raft.Raft service
+	AddServer(ctx context.Context, in *raft.ClusterMember, opts ...grpc.CallOption) (*raft.Configuration, error)
+	RemoveServer(ctx context.Context, in *raft.ClusterMember, opts ...grpc.CallOption) (*raft.Configuration, error)
+	PromoteLearner(ctx context.Context, in *raft.ClusterMember, opts ...grpc.CallOption) (*raft.Configuration, error)
+	TransferLeadership(ctx context.Context, in *raft.ClusterMember, opts ...grpc.CallOption) (*Success, error)
 	SetLeader(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Success, error)
 	SendHeartbeat(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Success, error)
+	GetClusterStatus(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*raft.ClusterStatus, error)
 	// metastore
 	GetFileInfoMap(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*FileInfoMap, error)
 	UpdateFile(ctx context.Context, in *FileMetaData, opts ...grpc.CallOption) (*Version, error)
@@ -348,6 +353,8 @@ type RaftSurfstoreClient interface {
 	IsCrashed(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*CrashedState, error)
 	Restore(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Success, error)
 	Crash(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Success, error)
+	SetNetworkFault(ctx context.Context, in *NetworkFault, opts ...grpc.CallOption) (*Success, error)
+	ClearNetworkFaults(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Success, error)
 }
 
 type raftSurfstoreClient struct {
@@ -358,9 +365,36 @@ func NewRaftSurfstoreClient(cc grpc.ClientConnInterface) RaftSurfstoreClient {
 	return &raftSurfstoreClient{cc}
 }
 
-func (c *raftSurfstoreClient) AppendEntries(ctx context.Context, in *AppendEntryInput, opts ...grpc.CallOption) (*AppendEntryOutput, error) {
-	out := new(AppendEntryOutput)
-	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/AppendEntries", in, out, opts...)
+func (c *raftSurfstoreClient) AddServer(ctx context.Context, in *raft.ClusterMember, opts ...grpc.CallOption) (*raft.Configuration, error) {
+	out := new(raft.Configuration)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/AddServer", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) RemoveServer(ctx context.Context, in *raft.ClusterMember, opts ...grpc.CallOption) (*raft.Configuration, error) {
+	out := new(raft.Configuration)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/RemoveServer", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) PromoteLearner(ctx context.Context, in *raft.ClusterMember, opts ...grpc.CallOption) (*raft.Configuration, error) {
+	out := new(raft.Configuration)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/PromoteLearner", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) TransferLeadership(ctx context.Context, in *raft.ClusterMember, opts ...grpc.CallOption) (*Success, error) {
+	out := new(Success)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/TransferLeadership", in, out, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -385,6 +419,15 @@ func (c *raftSurfstoreClient) SendHeartbeat(ctx context.Context, in *emptypb.Emp
 	return out, nil
 }
 
+func (c *raftSurfstoreClient) GetClusterStatus(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*raft.ClusterStatus, error) {
+	out := new(raft.ClusterStatus)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/GetClusterStatus", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *raftSurfstoreClient) GetFileInfoMap(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*FileInfoMap, error) {
 	out := new(FileInfoMap)
 	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/GetFileInfoMap", in, out, opts...)
@@ -448,14 +491,36 @@ func (c *raftSurfstoreClient) Crash(ctx context.Context, in *emptypb.Empty, opts
 	return out, nil
 }
 
+func (c *raftSurfstoreClient) SetNetworkFault(ctx context.Context, in *NetworkFault, opts ...grpc.CallOption) (*Success, error) {
+	out := new(Success)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/SetNetworkFault", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) ClearNetworkFaults(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Success, error) {
+	out := new(Success)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/ClearNetworkFaults", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // RaftSurfstoreServer is the server API for RaftSurfstore service.
 // All implementations must embed UnimplementedRaftSurfstoreServer
 // for forward compatibility
 type RaftSurfstoreServer interface {
-	// raft
-	AppendEntries(context.Context, *AppendEntryInput) (*AppendEntryOutput, error)
+	// raft, the RPCs between servers are in the raft.Raft service
+	AddServer(context.Context, *raft.ClusterMember) (*raft.Configuration, error)
+	RemoveServer(context.Context, *raft.ClusterMember) (*raft.Configuration, error)
+	PromoteLearner(context.Context, *raft.ClusterMember) (*raft.Configuration, error)
+	TransferLeadership(context.Context, *raft.ClusterMember) (*Success, error)
 	SetLeader(context.Context, *emptypb.Empty) (*Success, error)
 	SendHeartbeat(context.Context, *emptypb.Empty) (*Success, error)
+	GetClusterStatus(context.Context, *emptypb.Empty) (*raft.ClusterStatus, error)
 	// metastore
 	GetFileInfoMap(context.Context, *emptypb.Empty) (*FileInfoMap, error)
 	UpdateFile(context.Context, *FileMetaData) (*Version, error)
@@ -465,6 +530,8 @@ type RaftSurfstoreServer interface {
 	IsCrashed(context.Context, *emptypb.Empty) (*CrashedState, error)
 	Restore(context.Context, *emptypb.Empty) (*Success, error)
 	Crash(context.Context, *emptypb.Empty) (*Success, error)
+	SetNetworkFault(context.Context, *NetworkFault) (*Success, error)
+	ClearNetworkFaults(context.Context, *emptypb.Empty) (*Success, error)
 	mustEmbedUnimplementedRaftSurfstoreServer()
 }
 
@@ -472,8 +539,17 @@ type RaftSurfstoreServer interface {
 type UnimplementedRaftSurfstoreServer struct {
 }
 
-func (UnimplementedRaftSurfstoreServer) AppendEntries(context.Context, *AppendEntryInput) (*AppendEntryOutput, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method AppendEntries not implemented")
+func (UnimplementedRaftSurfstoreServer) AddServer(context.Context, *raft.ClusterMember) (*raft.Configuration, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddServer not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) RemoveServer(context.Context, *raft.ClusterMember) (*raft.Configuration, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RemoveServer not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) PromoteLearner(context.Context, *raft.ClusterMember) (*raft.Configuration, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PromoteLearner not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) TransferLeadership(context.Context, *raft.ClusterMember) (*Success, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method TransferLeadership not implemented")
 }
 func (UnimplementedRaftSurfstoreServer) SetLeader(context.Context, *emptypb.Empty) (*Success, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method SetLeader not implemented")
@@ -481,6 +557,9 @@ func (UnimplementedRaftSurfstoreServer) SetLeader(context.Context, *emptypb.Empt
 func (UnimplementedRaftSurfstoreServer) SendHeartbeat(context.Context, *emptypb.Empty) (*Success, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method SendHeartbeat not implemented")
 }
+func (UnimplementedRaftSurfstoreServer) GetClusterStatus(context.Context, *emptypb.Empty) (*raft.ClusterStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetClusterStatus not implemented")
+}
 func (UnimplementedRaftSurfstoreServer) GetFileInfoMap(context.Context, *emptypb.Empty) (*FileInfoMap, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetFileInfoMap not implemented")
 }
@@ -502,6 +581,12 @@ func (UnimplementedRaftSurfstoreServer) Restore(context.Context, *emptypb.Empty)
 func (UnimplementedRaftSurfstoreServer) Crash(context.Context, *emptypb.Empty) (*Success, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Crash not implemented")
 }
+func (UnimplementedRaftSurfstoreServer) SetNetworkFault(context.Context, *NetworkFault) (*Success, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetNetworkFault not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) ClearNetworkFaults(context.Context, *emptypb.Empty) (*Success, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ClearNetworkFaults not implemented")
+}
 func (UnimplementedRaftSurfstoreServer) mustEmbedUnimplementedRaftSurfstoreServer() {}
 
 // UnsafeRaftSurfstoreServer may be embedded to opt out of forward compatibility for this service.
@@ -515,20 +600,74 @@ func RegisterRaftSurfstoreServer(s grpc.ServiceRegistrar, srv RaftSurfstoreServe
 	s.RegisterService(&RaftSurfstore_ServiceDesc, srv)
 }
 
-func _RaftSurfstore_AppendEntries_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(AppendEntryInput)
+func _RaftSurfstore_AddServer_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(raft.ClusterMember)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).AddServer(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/AddServer",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).AddServer(ctx, req.(*raft.ClusterMember))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RaftSurfstore_RemoveServer_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(raft.ClusterMember)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
 	if interceptor == nil {
-		return srv.(RaftSurfstoreServer).AppendEntries(ctx, in)
+		return srv.(RaftSurfstoreServer).RemoveServer(ctx, in)
 	}
 	info := &grpc.UnaryServerInfo{
 		Server:     srv,
-		FullMethod: "/surfstore.RaftSurfstore/AppendEntries",
+		FullMethod: "/surfstore.RaftSurfstore/RemoveServer",
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(RaftSurfstoreServer).AppendEntries(ctx, req.(*AppendEntryInput))
+		return srv.(RaftSurfstoreServer).RemoveServer(ctx, req.(*raft.ClusterMember))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RaftSurfstore_PromoteLearner_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(raft.ClusterMember)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).PromoteLearner(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/PromoteLearner",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).PromoteLearner(ctx, req.(*raft.ClusterMember))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RaftSurfstore_TransferLeadership_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(raft.ClusterMember)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).TransferLeadership(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/TransferLeadership",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).TransferLeadership(ctx, req.(*raft.ClusterMember))
 	}
 	return interceptor(ctx, in, info, handler)
 }
@@ -569,6 +708,24 @@ func _RaftSurfstore_SendHeartbeat_Handler(srv interface{}, ctx context.Context,
 	return interceptor(ctx, in, info, handler)
 }
 
+func _RaftSurfstore_GetClusterStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).GetClusterStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/GetClusterStatus",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).GetClusterStatus(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _RaftSurfstore_GetFileInfoMap_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(emptypb.Empty)
 	if err := dec(in); err != nil {
@@ -695,6 +852,42 @@ func _RaftSurfstore_Crash_Handler(srv interface{}, ctx context.Context, dec func
 	return interceptor(ctx, in, info, handler)
 }
 
+func _RaftSurfstore_SetNetworkFault_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(NetworkFault)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).SetNetworkFault(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/SetNetworkFault",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).SetNetworkFault(ctx, req.(*NetworkFault))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RaftSurfstore_ClearNetworkFaults_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).ClearNetworkFaults(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/ClearNetworkFaults",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).ClearNetworkFaults(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // RaftSurfstore_ServiceDesc is the grpc.ServiceDesc for RaftSurfstore service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -703,8 +896,20 @@ var RaftSurfstore_ServiceDesc = grpc.ServiceDesc{
 	HandlerType: (*RaftSurfstoreServer)(nil),
 	Methods: []grpc.MethodDesc{
 		{
-			MethodName: "AppendEntries",
-			Handler:    _RaftSurfstore_AppendEntries_Handler,
+			MethodName: "AddServer",
+			Handler:    _RaftSurfstore_AddServer_Handler,
+		},
+		{
+			MethodName: "RemoveServer",
+			Handler:    _RaftSurfstore_RemoveServer_Handler,
+		},
+		{
+			MethodName: "PromoteLearner",
+			Handler:    _RaftSurfstore_PromoteLearner_Handler,
+		},
+		{
+			MethodName: "TransferLeadership",
+			Handler:    _RaftSurfstore_TransferLeadership_Handler,
 		},
 		{
 			MethodName: "SetLeader",
@@ -714,6 +919,10 @@ var RaftSurfstore_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "SendHeartbeat",
 			Handler:    _RaftSurfstore_SendHeartbeat_Handler,
 		},
+		{
+			MethodName: "GetClusterStatus",
+			Handler:    _RaftSurfstore_GetClusterStatus_Handler,
+		},
 		{
 			MethodName: "GetFileInfoMap",
 			Handler:    _RaftSurfstore_GetFileInfoMap_Handler,
@@ -742,6 +951,14 @@ var RaftSurfstore_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Crash",
 			Handler:    _RaftSurfstore_Crash_Handler,
 		},
+		{
+			MethodName: "SetNetworkFault",
+			Handler:    _RaftSurfstore_SetNetworkFault_Handler,
+		},
+		{
+			MethodName: "ClearNetworkFaults",
+			Handler:    _RaftSurfstore_ClearNetworkFaults_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "pkg/surfstore/SurfStore.proto",
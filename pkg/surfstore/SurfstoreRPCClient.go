@@ -2,12 +2,19 @@ package surfstore
 
 import (
 	context "context"
+	"crypto/rand"
+	"cse224/proj5/pkg/raft"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"log"
 	"time"
 
 	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 	emptypb "google.golang.org/protobuf/types/known/emptypb"
 )
 
@@ -15,6 +22,14 @@ type RPCClient struct {
 	MetaStoreAddrs []string
 	BaseDir        string
 	BlockSize      int
+
+	// The last server that answered as the leader
+	leaderAddr string
+
+	// Identifies this client's updates, so the servers apply each one once
+	// however often it is retried
+	clientId    string
+	sequenceNum int64
 }
 
 func (surfClient *RPCClient) GetBlock(blockHash string, blockStoreAddr string, block *Block) error {
@@ -97,66 +112,169 @@ func (surfClient *RPCClient) HasBlocks(blockHashesIn []string, blockStoreAddr st
 
 func (surfClient *RPCClient) GetFileInfoMap(serverFileInfoMap *map[string]*FileMetaData) error {
 
-	for _, addr := range surfClient.MetaStoreAddrs {
-		conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	return surfClient.callLeader(func(ctx context.Context, m RaftSurfstoreClient) error {
+		empty := new(emptypb.Empty)
+		FileInfoMap, err := m.GetFileInfoMap(ctx, empty)
 		if err != nil {
-			// return err
-			continue
+			return err
 		}
 
-		defer conn.Close()
-		m := NewRaftSurfstoreClient(conn)
+		*serverFileInfoMap = FileInfoMap.FileInfoMap
+		return nil
+	})
 
-		// perform the call
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-		defer cancel()
+}
 
-		empty := new(emptypb.Empty)
-		FileInfoMap, err := m.GetFileInfoMap(ctx, empty)
+func (surfClient *RPCClient) UpdateFile(fileMetaData *FileMetaData, latestVersion *int32) error {
+
+	// every retry carries the same sequence number
+	surfClient.sequenceNum++
+	request := proto.Clone(fileMetaData).(*FileMetaData)
+	request.ClientId = surfClient.clientId
+	request.SequenceNum = surfClient.sequenceNum
 
+	return surfClient.callLeader(func(ctx context.Context, m RaftSurfstoreClient) error {
+		updatedVersion, err := m.UpdateFile(ctx, request)
 		if err != nil {
-			conn.Close()
-			continue
+			return err
 		}
 
-		*serverFileInfoMap = FileInfoMap.FileInfoMap
+		*latestVersion = updatedVersion.Version
+		return nil
+	})
 
-		return conn.Close()
+}
 
-	}
+// Adds server serverId at addr to the cluster, as a learner if learner is
+// set, returning the members of the new configuration
+func (surfClient *RPCClient) AddServer(serverId int64, addr string, learner bool, members *[]*raft.ClusterMember) error {
 
-	return errors.New("servers not found")
+	return surfClient.callLeader(func(ctx context.Context, m RaftSurfstoreClient) error {
+		configuration, err := m.AddServer(ctx, &raft.ClusterMember{ServerId: serverId, Addr: addr, Learner: learner})
+		if err != nil {
+			return err
+		}
+
+		*members = configuration.Members
+		return nil
+	})
 
 }
 
-func (surfClient *RPCClient) UpdateFile(fileMetaData *FileMetaData, latestVersion *int32) error {
+func (surfClient *RPCClient) RemoveServer(serverId int64, members *[]*raft.ClusterMember) error {
 
-	for _, addr := range surfClient.MetaStoreAddrs {
-		conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	return surfClient.callLeader(func(ctx context.Context, m RaftSurfstoreClient) error {
+		configuration, err := m.RemoveServer(ctx, &raft.ClusterMember{ServerId: serverId})
 		if err != nil {
-			continue
+			return err
 		}
-		defer conn.Close()
-		m := NewRaftSurfstoreClient(conn)
 
-		// perform the call
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-		defer cancel()
+		*members = configuration.Members
+		return nil
+	})
 
-		updatedVersion, err := m.UpdateFile(ctx, fileMetaData)
+}
 
+func (surfClient *RPCClient) PromoteLearner(serverId int64, members *[]*raft.ClusterMember) error {
+
+	return surfClient.callLeader(func(ctx context.Context, m RaftSurfstoreClient) error {
+		configuration, err := m.PromoteLearner(ctx, &raft.ClusterMember{ServerId: serverId})
 		if err != nil {
-			conn.Close()
-			continue
+			return err
 		}
 
-		*latestVersion = updatedVersion.Version
+		*members = configuration.Members
+		return nil
+	})
 
-		return conn.Close()
+}
+
+// Asks the leader to hand over to serverId, succ is false if it didn't take
+// over in time
+func (surfClient *RPCClient) TransferLeadership(serverId int64, succ *bool) error {
+
+	return surfClient.callLeader(func(ctx context.Context, m RaftSurfstoreClient) error {
+		success, err := m.TransferLeadership(ctx, &raft.ClusterMember{ServerId: serverId})
+		if err != nil {
+			return err
+		}
+
+		*succ = success.Flag
+		return nil
+	})
+
+}
+
+// Asks the server at addr itself, not the leader, what it knows about the
+// cluster
+func (surfClient *RPCClient) GetClusterStatus(addr string, clusterStatus **raft.ClusterStatus) error {
+
+	return callMetaStore(addr, func(ctx context.Context, m RaftSurfstoreClient) error {
+		status, err := m.GetClusterStatus(ctx, &emptypb.Empty{})
+		if err != nil {
+			return err
+		}
+
+		*clusterStatus = status
+		return nil
+	})
+
+}
+
+// Runs call against the leader, starting with the last server that answered
+// as one. Followers reply with the leader's address, which we follow; servers
+// that are down, or followers that know of no leader during an election, make
+// us move on to the next address. Any other error comes from the leader and
+// is returned as is.
+func (surfClient *RPCClient) callLeader(call func(ctx context.Context, m RaftSurfstoreClient) error) error {
+	addr := surfClient.leaderAddr
+	if addr == "" {
+		addr = surfClient.MetaStoreAddrs[0]
 	}
+	next := 0
 
-	return errors.New("all servers down")
+	for attempt := 0; attempt < LEADER_SEARCH_ROUNDS*len(surfClient.MetaStoreAddrs); attempt++ {
+		err := callMetaStore(addr, call)
+		if err == nil {
+			surfClient.leaderAddr = addr
+			return nil
+		}
 
+		leaderAddr, notLeader := LeaderAddrFromError(err)
+		if notLeader && leaderAddr != "" && leaderAddr != addr {
+			addr = leaderAddr
+			continue
+		}
+		if notLeader && leaderAddr == "" {
+			// give the election time to finish
+			time.Sleep(LEADER_RETRY_INTERVAL)
+		}
+		if !notLeader {
+			if code := status.Code(err); code != codes.Unavailable && code != codes.DeadlineExceeded {
+				return err
+			}
+		}
+
+		addr = surfClient.MetaStoreAddrs[next%len(surfClient.MetaStoreAddrs)]
+		next++
+	}
+
+	surfClient.leaderAddr = ""
+	return errors.New("no leader found")
+}
+
+func callMetaStore(addr string, call func(ctx context.Context, m RaftSurfstoreClient) error) error {
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	defer conn.Close()
+	m := NewRaftSurfstoreClient(conn)
+
+	// perform the call
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return call(ctx, m)
 }
 
 func (surfClient *RPCClient) GetBlockStoreAddr(blockStoreAddr *string) error {
@@ -200,5 +318,15 @@ func NewSurfstoreRPCClient(addrs []string, baseDir string, blockSize int) RPCCli
 		MetaStoreAddrs: addrs,
 		BaseDir:        baseDir,
 		BlockSize:      blockSize,
+		clientId:       newClientId(),
+	}
+}
+
+// A random ID, unique to each client with overwhelming probability
+func newClientId() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		log.Fatal("Error generating client ID: ", err)
 	}
+	return hex.EncodeToString(id)
 }
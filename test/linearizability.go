@@ -0,0 +1,173 @@
+package SurfTest
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// An operation of a history: what a client asked for and got back, and when
+// it called and returned. Times only need to be ordered, they don't have to
+// be real. An operation whose outcome the client never learned returns at
+// UNKNOWN_RETURN, so it may take effect at any point after its call.
+type Operation struct {
+	ClientId int
+	Input    interface{}
+	Call     int64
+	Output   interface{}
+	Return   int64
+}
+
+const UNKNOWN_RETURN int64 = math.MaxInt64
+
+// The sequential specification a history is checked against
+type Model struct {
+	Init func() interface{}
+	// The states state can move to by applying input and answering output,
+	// none if output is not a possible answer. More than one lets an
+	// operation with an unknown outcome either take effect or not.
+	Step func(state, input, output interface{}) []interface{}
+	// Identifies a state, states with the same key must behave the same
+	Key func(state interface{}) string
+}
+
+type CheckResult int
+
+const (
+	LINEARIZABLE CheckResult = iota
+	NOT_LINEARIZABLE
+	CHECK_TIMED_OUT
+)
+
+// How many search steps run between looks at the clock
+const CHECK_DEADLINE_STEPS = 1024
+
+// One end of an operation in the list the search walks through
+type historyEntry struct {
+	id     int
+	isCall bool
+	op     *Operation
+	time   int64
+	// the return of a call
+	match      *historyEntry
+	prev, next *historyEntry
+}
+
+// A call the search linearized, with the state before it and the states it
+// could still move to instead
+type searchFrame struct {
+	entry        *historyEntry
+	state        interface{}
+	alternatives []interface{}
+}
+
+// Checks whether history is linearizable with respect to model, giving up
+// after timeout. This is the search of Wing and Gong with the memoization of
+// Lowe, as Porcupine does it: linearize any call that hasn't returned yet,
+// backtrack when reaching a return whose call isn't linearized, and skip
+// (set of linearized operations, state) pairs that were already explored.
+func CheckOperations(model Model, history []Operation, timeout time.Duration) CheckResult {
+	head := buildEntries(history)
+	deadline := time.Now().Add(timeout)
+	state := model.Init()
+	linearized := make([]byte, (len(history)+7)/8)
+	explored := make(map[string]bool)
+	stack := make([]searchFrame, 0, len(history))
+
+	entry := head.next
+	// linearizes the call entry with the first of states not explored yet
+	linearize := func(call *historyEntry, states []interface{}) bool {
+		linearized[call.id/8] |= 1 << (call.id % 8)
+		for i, next := range states {
+			key := string(linearized) + "\x00" + model.Key(next)
+			if explored[key] {
+				continue
+			}
+			explored[key] = true
+			stack = append(stack, searchFrame{entry: call, state: state, alternatives: states[i+1:]})
+			state = next
+			liftEntry(call)
+			entry = head.next
+			return true
+		}
+		linearized[call.id/8] &^= 1 << (call.id % 8)
+		return false
+	}
+
+	for steps := 1; head.next != nil; steps++ {
+		if steps%CHECK_DEADLINE_STEPS == 0 && time.Now().After(deadline) {
+			return CHECK_TIMED_OUT
+		}
+
+		if entry.isCall {
+			if !linearize(entry, model.Step(state, entry.op.Input, entry.op.Output)) {
+				entry = entry.next
+			}
+			continue
+		}
+
+		// an operation returned before it could be linearized, undo the
+		// last choice
+		if len(stack) == 0 {
+			return NOT_LINEARIZABLE
+		}
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		state = top.state
+		linearized[top.entry.id/8] &^= 1 << (top.entry.id % 8)
+		unliftEntry(top.entry)
+		if !linearize(top.entry, top.alternatives) {
+			entry = top.entry.next
+		}
+	}
+	return LINEARIZABLE
+}
+
+// Lays the calls and returns of history out in time order behind a sentinel.
+// A call and a return at the same time count as overlapping.
+func buildEntries(history []Operation) *historyEntry {
+	entries := make([]*historyEntry, 0, 2*len(history))
+	for id := range history {
+		op := &history[id]
+		ret := &historyEntry{id: id, op: op, time: op.Return}
+		call := &historyEntry{id: id, isCall: true, op: op, time: op.Call, match: ret}
+		entries = append(entries, call, ret)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].time != entries[j].time {
+			return entries[i].time < entries[j].time
+		}
+		return entries[i].isCall && !entries[j].isCall
+	})
+
+	head := &historyEntry{}
+	prev := head
+	for _, entry := range entries {
+		prev.next = entry
+		entry.prev = prev
+		prev = entry
+	}
+	return head
+}
+
+// Takes a call and its return out of the list
+func liftEntry(call *historyEntry) {
+	call.prev.next = call.next
+	call.next.prev = call.prev
+	ret := call.match
+	ret.prev.next = ret.next
+	if ret.next != nil {
+		ret.next.prev = ret.prev
+	}
+}
+
+// Puts back what liftEntry took out
+func unliftEntry(call *historyEntry) {
+	ret := call.match
+	ret.prev.next = ret
+	if ret.next != nil {
+		ret.next.prev = ret
+	}
+	call.prev.next = call
+	call.next.prev = call
+}
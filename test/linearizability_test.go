@@ -0,0 +1,152 @@
+package SurfTest
+
+import (
+	"cse224/proj5/pkg/surfstore"
+	"flag"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+var linearizabilitySeed = flag.Int64("linearizability.seed", 0, "seed of the faults and client workload, 0 picks one from the clock")
+
+func TestLinearizabilityCheckerMetaStoreModel(t *testing.T) {
+	update := func(client int, version int32, call int64, out MetaStoreOutput, ret int64) Operation {
+		return Operation{ClientId: client, Input: MetaStoreInput{Update: true, Filename: "testFile1", Version: version}, Call: call, Output: out, Return: ret}
+	}
+	read := func(client int, versions map[string]int32, call, ret int64) Operation {
+		return Operation{ClientId: client, Input: MetaStoreInput{}, Call: call, Output: MetaStoreOutput{FileInfoMap: versions}, Return: ret}
+	}
+	none := map[string]int32{}
+	one := map[string]int32{"testFile1": 1}
+
+	tests := []struct {
+		name    string
+		history []Operation
+		want    CheckResult
+	}{
+		{"stale read after update", []Operation{
+			update(1, 1, 1, MetaStoreOutput{Version: 1}, 2),
+			read(2, none, 3, 4),
+		}, NOT_LINEARIZABLE},
+		{"read concurrent with update", []Operation{
+			read(2, none, 1, 4),
+			update(1, 1, 2, MetaStoreOutput{Version: 1}, 3),
+		}, LINEARIZABLE},
+		{"rejected update that should apply", []Operation{
+			update(1, 1, 1, MetaStoreOutput{Rejected: true}, 2),
+		}, NOT_LINEARIZABLE},
+		{"conflicting updates, one wins", []Operation{
+			update(1, 1, 1, MetaStoreOutput{Version: 1}, 4),
+			update(2, 1, 2, MetaStoreOutput{Rejected: true}, 3),
+		}, LINEARIZABLE},
+		{"unknown update applied late", []Operation{
+			update(1, 1, 1, MetaStoreOutput{Unknown: true}, UNKNOWN_RETURN),
+			read(2, none, 2, 3),
+			read(2, one, 4, 5),
+		}, LINEARIZABLE},
+		{"unknown update undone", []Operation{
+			update(1, 1, 1, MetaStoreOutput{Unknown: true}, UNKNOWN_RETURN),
+			read(2, one, 2, 3),
+			read(2, none, 4, 5),
+		}, NOT_LINEARIZABLE},
+	}
+	for _, test := range tests {
+		if got := CheckOperations(MetaStoreModel, test.history, time.Second); got != test.want {
+			t.Fatalf("%s: got %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+// Clients read and update a few files while servers get isolated, crashed
+// and restored, then the recorded history is checked against MetaStoreModel.
+// Each client stops after 25 operations, which keeps the check well within
+// its timeout.
+func TestRaftLinearizableUnderFaults(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitElectionTest(cfgPath, "8080")
+	defer EndTest(test)
+
+	// TEST
+	if WaitForLeader(test, 5*time.Second) == -1 {
+		t.Fatalf("No leader was elected")
+	}
+	seed := *linearizabilitySeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	recorder := &HistoryRecorder{}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	filenames := []string{"testFile1", "testFile2"}
+	for i := 0; i < 4; i++ {
+		client := recorder.Client(surfstore.NewSurfstoreRPCClient(test.Ips, "", BLOCK_SIZE))
+		random := rand.New(rand.NewSource(seed + int64(i)))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// the versions this client last saw, often stale on purpose
+			known := make(map[string]int32)
+			for ops := 0; ops < 25; ops++ {
+				select {
+				case <-stop:
+					return
+				case <-time.After(time.Duration(random.Intn(400)) * time.Millisecond):
+				}
+				if random.Intn(3) == 0 {
+					var fileInfoMap map[string]*surfstore.FileMetaData
+					if client.GetFileInfoMap(&fileInfoMap) == nil {
+						for filename, filemeta := range fileInfoMap {
+							known[filename] = filemeta.Version
+						}
+					}
+					continue
+				}
+				filename := filenames[random.Intn(len(filenames))]
+				filemeta := &surfstore.FileMetaData{Filename: filename, Version: known[filename] + 1}
+				var version int32
+				if client.UpdateFile(filemeta, &version) == nil {
+					known[filename] = version
+				}
+			}
+		}()
+	}
+
+	random := rand.New(rand.NewSource(seed))
+	for step := 0; step < 15; step++ {
+		idx := random.Intn(len(test.Clients))
+		switch random.Intn(4) {
+		case 0:
+			IsolateServer(test, idx)
+		case 1:
+			test.Clients[idx].Crash(test.Context, &emptypb.Empty{})
+		default:
+			HealNetwork(test)
+			for _, server := range test.Clients {
+				server.Restore(test.Context, &emptypb.Empty{})
+			}
+		}
+		time.Sleep(400 * time.Millisecond)
+	}
+	HealNetwork(test)
+	for _, server := range test.Clients {
+		server.Restore(test.Context, &emptypb.Empty{})
+	}
+	close(stop)
+	wg.Wait()
+
+	history := recorder.History()
+	switch CheckOperations(MetaStoreModel, history, 30*time.Second) {
+	case NOT_LINEARIZABLE:
+		for _, op := range history {
+			t.Logf("client %d: %v -> %v [%d, %d]", op.ClientId, op.Input, op.Output, op.Call, op.Return)
+		}
+		t.Fatalf("History of %d operations is not linearizable, -args -linearizability.seed=%d reruns the same workload", len(history), seed)
+	case CHECK_TIMED_OUT:
+		t.Fatalf("Checking %d operations timed out, -args -linearizability.seed=%d reruns the same workload", len(history), seed)
+	}
+}
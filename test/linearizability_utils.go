@@ -0,0 +1,227 @@
+package SurfTest
+
+import (
+	"cse224/proj5/pkg/surfstore"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// An UpdateFile, or a GetFileInfoMap when Update is false
+type MetaStoreInput struct {
+	Update   bool
+	Filename string
+	Version  int32
+}
+
+// What the client got back. An update is either accepted with Version,
+// rejected by the MetaStore, or has an unknown outcome when the client gave
+// up on it without an answer.
+type MetaStoreOutput struct {
+	Unknown     bool
+	Rejected    bool
+	Version     int32
+	FileInfoMap map[string]int32
+}
+
+func (in MetaStoreInput) String() string {
+	if !in.Update {
+		return "GetFileInfoMap()"
+	}
+	return fmt.Sprintf("UpdateFile(%s, %d)", in.Filename, in.Version)
+}
+
+func (out MetaStoreOutput) String() string {
+	switch {
+	case out.Unknown:
+		return "unknown"
+	case out.Rejected:
+		return "rejected"
+	case out.FileInfoMap != nil:
+		return versionsKey(out.FileInfoMap)
+	default:
+		return fmt.Sprintf("%d", out.Version)
+	}
+}
+
+// The version rules of MetaStore.UpdateFile: an update is applied when its
+// version is one more than the stored one, a missing file counting as
+// version 0, and rejected otherwise. The state maps filenames to versions.
+var MetaStoreModel = Model{
+	Init: func() interface{} {
+		return map[string]int32{}
+	},
+	Step: func(state, input, output interface{}) []interface{} {
+		versions := state.(map[string]int32)
+		in := input.(MetaStoreInput)
+		out := output.(MetaStoreOutput)
+
+		if !in.Update {
+			if versionsKey(versions) != versionsKey(out.FileInfoMap) {
+				return nil
+			}
+			return []interface{}{versions}
+		}
+
+		applies := versions[in.Filename] == in.Version-1
+		switch {
+		case out.Unknown && applies:
+			return []interface{}{withVersion(versions, in.Filename, in.Version), versions}
+		case out.Unknown, out.Rejected && !applies:
+			return []interface{}{versions}
+		case !out.Rejected && applies && out.Version == in.Version:
+			return []interface{}{withVersion(versions, in.Filename, in.Version)}
+		}
+		return nil
+	},
+	Key: func(state interface{}) string {
+		return versionsKey(state.(map[string]int32))
+	},
+}
+
+func withVersion(versions map[string]int32, filename string, version int32) map[string]int32 {
+	updated := make(map[string]int32, len(versions)+1)
+	for name, v := range versions {
+		updated[name] = v
+	}
+	updated[filename] = version
+	return updated
+}
+
+func versionsKey(versions map[string]int32) string {
+	names := make([]string, 0, len(versions))
+	for name := range versions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var key strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&key, "%s=%d;", name, versions[name])
+	}
+	return key.String()
+}
+
+// Records what clients send to the MetaStore and what they get back as a
+// history for CheckOperations. Times come from a counter shared by all the
+// clients, so they order the calls and returns as they happened.
+type HistoryRecorder struct {
+	mutex   sync.Mutex
+	time    int64
+	clients int
+	history []Operation
+}
+
+// Wraps client so that its MetaStore operations go into the history
+func (h *HistoryRecorder) Client(client surfstore.RPCClient) *RecordingClient {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.clients++
+	return &RecordingClient{client: client, id: h.clients, recorder: h}
+}
+
+func (h *HistoryRecorder) History() []Operation {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return append([]Operation(nil), h.history...)
+}
+
+func (h *HistoryRecorder) now() int64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.time++
+	return h.time
+}
+
+// Adds op to the history, returning where it went
+func (h *HistoryRecorder) record(op Operation) int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.history = append(h.history, op)
+	return len(h.history) - 1
+}
+
+// Lets the operations at indexes return by ret at the latest
+func (h *HistoryRecorder) resolve(indexes []int, ret int64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, idx := range indexes {
+		h.history[idx].Return = ret
+	}
+}
+
+// An RPCClient whose GetFileInfoMap and UpdateFile are recorded. Like the
+// RPCClient, it is used by one goroutine at a time.
+type RecordingClient struct {
+	client   surfstore.RPCClient
+	id       int
+	recorder *HistoryRecorder
+
+	// Updates of this client with an unknown outcome since its last answered one
+	unknown []int
+}
+
+// A failed read didn't change anything, so it is left out of the history
+func (c *RecordingClient) GetFileInfoMap(serverFileInfoMap *map[string]*surfstore.FileMetaData) error {
+	call := c.recorder.now()
+	err := c.client.GetFileInfoMap(serverFileInfoMap)
+	ret := c.recorder.now()
+	if err != nil {
+		return err
+	}
+
+	versions := make(map[string]int32, len(*serverFileInfoMap))
+	for filename, filemeta := range *serverFileInfoMap {
+		versions[filename] = filemeta.Version
+	}
+	c.recorder.record(Operation{
+		ClientId: c.id,
+		Input:    MetaStoreInput{},
+		Call:     call,
+		Output:   MetaStoreOutput{FileInfoMap: versions},
+		Return:   ret,
+	})
+	return nil
+}
+
+func (c *RecordingClient) UpdateFile(fileMetaData *surfstore.FileMetaData, latestVersion *int32) error {
+	call := c.recorder.now()
+	err := c.client.UpdateFile(fileMetaData, latestVersion)
+	ret := c.recorder.now()
+
+	out := MetaStoreOutput{Version: *latestVersion}
+	if err != nil {
+		out = updateOutcome(err)
+	}
+	op := Operation{
+		ClientId: c.id,
+		Input:    MetaStoreInput{Update: true, Filename: fileMetaData.Filename, Version: fileMetaData.Version},
+		Call:     call,
+		Output:   out,
+		Return:   ret,
+	}
+	if out.Unknown {
+		op.Return = UNKNOWN_RETURN
+		c.unknown = append(c.unknown, c.recorder.record(op))
+		return err
+	}
+
+	// The MetaStore answered an update with a newer sequence number, so it
+	// rejects the earlier ones as stale if they come after it
+	c.recorder.record(op)
+	c.recorder.resolve(c.unknown, ret)
+	c.unknown = nil
+	return err
+}
+
+// Only the MetaStore's own errors reach the client as codes.Unknown. Every
+// other failure, such as a timeout, a crashed server or no leader found,
+// leaves open whether the update was committed.
+func updateOutcome(err error) MetaStoreOutput {
+	if s, ok := status.FromError(err); ok && s.Code() == codes.Unknown {
+		return MetaStoreOutput{Rejected: true}
+	}
+	return MetaStoreOutput{Unknown: true}
+}
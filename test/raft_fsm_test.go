@@ -0,0 +1,440 @@
+package SurfTest
+
+import (
+	context "context"
+	"cse224/proj5/pkg/raft"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Keeps every command it applied, in order
+type listFSM struct {
+	mutex    sync.Mutex
+	commands []string
+}
+
+func (f *listFSM) Apply(command []byte) interface{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.commands = append(f.commands, string(command))
+	return len(f.commands)
+}
+
+func (f *listFSM) Snapshot() ([]byte, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return []byte(strings.Join(f.commands, "\n")), nil
+}
+
+func (f *listFSM) Restore(snapshot []byte) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.commands = nil
+	if len(snapshot) > 0 {
+		f.commands = strings.Split(string(snapshot), "\n")
+	}
+	return nil
+}
+
+func (f *listFSM) list() string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return strings.Join(f.commands, ",")
+}
+
+// Starts a raft.Server with its own listFSM for every address in ips, talking
+// over network, with opts apart from the Transport. They are stopped when
+// the test ends.
+func startFSMCluster(t *testing.T, network *raft.InmemNetwork, ips []string, opts raft.Options) ([]*raft.Server, []*listFSM) {
+	servers := make([]*raft.Server, len(ips))
+	fsms := make([]*listFSM, len(ips))
+	for idx, ip := range ips {
+		fsms[idx] = &listFSM{}
+		opts.Transport = network.Transport(ip)
+		server, err := raft.NewServer(int64(idx), ips, fsms[idx], opts)
+		if err != nil {
+			t.Fatalf("Could not create server %d: %v", idx, err)
+		}
+		network.Register(ip, server)
+		servers[idx] = server
+	}
+	for _, server := range servers {
+		server.Start()
+		t.Cleanup(server.Stop)
+	}
+	return servers, fsms
+}
+
+func TestRaftReplicatesAnyFSM(t *testing.T) {
+	//Setup
+	servers, fsms := startFSMCluster(t, raft.NewInmemNetwork(), []string{"fsm0", "fsm1", "fsm2"}, raft.Options{
+		SnapshotThreshold: 4,
+	})
+
+	// TEST
+	leader := -1
+	for deadline := time.Now().Add(5 * time.Second); leader == -1 && time.Now().Before(deadline); {
+		for idx, server := range servers {
+			if server.State().IsLeader {
+				leader = idx
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if leader == -1 {
+		t.Fatalf("No leader was elected")
+	}
+
+	var want []string
+	for i := 1; i <= 10; i++ {
+		command := "command" + strconv.Itoa(i)
+		result, err := servers[leader].Propose(context.Background(), []byte(command))
+		if err != nil {
+			t.Fatalf("Propose failed: %v", err)
+		}
+		if result.(int) != i {
+			t.Fatalf("Apply of command %d returned %v", i, result)
+		}
+		want = append(want, command)
+	}
+
+	time.Sleep(2 * raft.HEARTBEAT_INTERVAL)
+	for idx, fsm := range fsms {
+		if got := fsm.list(); got != strings.Join(want, ",") {
+			t.Fatalf("Server %d applied %s", idx, got)
+		}
+	}
+}
+
+// A listFSM whose Apply waits until release is closed, announcing each call
+// on applying first
+type gatedFSM struct {
+	listFSM
+	applying chan bool
+	release  chan bool
+}
+
+func (f *gatedFSM) Apply(command []byte) interface{} {
+	f.applying <- true
+	<-f.release
+	return f.listFSM.Apply(command)
+}
+
+func TestRaftSlowApplyDoesNotBlockServer(t *testing.T) {
+	//Setup
+	network := raft.NewInmemNetwork()
+	fsm := &gatedFSM{applying: make(chan bool, 1), release: make(chan bool)}
+	var releaseOnce sync.Once
+	release := func() { releaseOnce.Do(func() { close(fsm.release) }) }
+	defer release()
+	server, err := raft.NewServer(0, []string{"slow0"}, fsm, raft.Options{
+		Transport: network.Transport("slow0"),
+	})
+	if err != nil {
+		t.Fatalf("Could not create server: %v", err)
+	}
+	network.Register("slow0", server)
+	server.Start()
+	defer server.Stop()
+
+	// TEST
+	for deadline := time.Now().Add(5 * time.Second); !server.State().IsLeader; time.Sleep(50 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("No leader was elected")
+		}
+	}
+
+	proposed := make(chan error, 1)
+	go func() {
+		_, err := server.Propose(context.Background(), []byte("command1"))
+		proposed <- err
+	}()
+	select {
+	case <-fsm.applying:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The command was never applied")
+	}
+
+	// the server keeps answering while the FSM is busy
+	statuses := make(chan *raft.ClusterStatus, 1)
+	go func() {
+		statuses <- server.ClusterStatus()
+	}()
+	select {
+	case status := <-statuses:
+		if status.LastApplied >= status.CommitIndex {
+			t.Fatalf("Command counted as applied at %d before Apply returned", status.LastApplied)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("ClusterStatus blocked while the FSM was applying")
+	}
+
+	release()
+	if err := <-proposed; err != nil {
+		t.Fatalf("Propose failed: %v", err)
+	}
+}
+
+func TestRaftTransferRefusedDuringConfigChange(t *testing.T) {
+	//Setup
+	servers, _ := startFSMCluster(t, raft.NewInmemNetwork(), []string{"fsm0", "fsm1", "fsm2"}, raft.Options{
+		ManualElection: true,
+	})
+
+	// TEST
+	servers[0].SetLeader()
+	servers[0].SendHeartbeat()
+
+	// without a majority the new configuration can't commit
+	servers[1].Crash()
+	servers[2].Crash()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	changed := make(chan error, 1)
+	go func() {
+		_, err := servers[0].AddServer(ctx, &raft.ClusterMember{ServerId: 3, Addr: "fsm3", Learner: true})
+		changed <- err
+	}()
+	for deadline := time.Now().Add(time.Second); len(servers[0].ClusterStatus().Configuration.Members) != 4; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("The new configuration was never appended")
+		}
+	}
+
+	_, err := servers[0].TransferLeadership(context.Background(), &raft.ClusterMember{ServerId: 1})
+	if err != raft.ERR_CONFIG_CHANGE_PENDING {
+		t.Fatalf("Transfer should have been refused with ERR_CONFIG_CHANGE_PENDING, got %v", err)
+	}
+	if !servers[0].State().IsLeader {
+		t.Fatalf("Server 0 should still be the leader")
+	}
+	<-changed
+}
+
+func TestRaftConfigChangeRefusedDuringTransfer(t *testing.T) {
+	//Setup
+	servers, _ := startFSMCluster(t, raft.NewInmemNetwork(), []string{"fsm0", "fsm1", "fsm2"}, raft.Options{
+		ManualElection: true,
+	})
+
+	// TEST
+	// a crashed target never catches up, so the transfer runs until it times out
+	servers[2].Crash()
+	servers[0].SetLeader()
+	if _, err := servers[0].Propose(context.Background(), []byte("command1")); err != nil {
+		t.Fatalf("Propose failed: %v", err)
+	}
+
+	transferred := make(chan bool, 1)
+	go func() {
+		success, _ := servers[0].TransferLeadership(context.Background(), &raft.ClusterMember{ServerId: 2})
+		transferred <- success != nil && success.Flag
+	}()
+	time.Sleep(raft.TRANSFER_TIMEOUT / 4)
+
+	member := &raft.ClusterMember{ServerId: 3, Addr: "fsm3", Learner: true}
+	if _, err := servers[0].AddServer(context.Background(), member); err == nil {
+		t.Fatalf("Configuration change should have been refused during the transfer")
+	} else if _, notLeader := raft.LeaderAddrFromError(err); !notLeader {
+		t.Fatalf("Configuration change should have failed with NotLeader, got %v", err)
+	}
+
+	if <-transferred {
+		t.Fatalf("Transfer to a crashed server should have failed")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := servers[0].AddServer(ctx, member); err != nil {
+		t.Fatalf("Configuration change after the transfer failed: %v", err)
+	}
+}
+
+func TestRaftReadIndexReportsCallerDeadline(t *testing.T) {
+	//Setup
+	servers, _ := startFSMCluster(t, raft.NewInmemNetwork(), []string{"fsm0", "fsm1", "fsm2"}, raft.Options{
+		ManualElection: true,
+	})
+
+	// TEST
+	servers[0].SetLeader()
+	servers[1].Crash()
+	servers[2].Crash()
+
+	// the caller gives up before READ_INDEX_TIMEOUT, which isn't a lost quorum
+	ctx, cancel := context.WithTimeout(context.Background(), raft.READ_INDEX_TIMEOUT/5)
+	defer cancel()
+	if err := servers[0].ReadIndex(ctx); status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("Read past the caller's deadline should fail with DeadlineExceeded, got %v", err)
+	}
+
+	if err := servers[0].ReadIndex(context.Background()); err != raft.ERR_NO_QUORUM {
+		t.Fatalf("Read without a majority should fail with ERR_NO_QUORUM, got %v", err)
+	}
+}
+
+func TestRaftOneTransferAtATime(t *testing.T) {
+	//Setup
+	servers, _ := startFSMCluster(t, raft.NewInmemNetwork(), []string{"fsm0", "fsm1", "fsm2"}, raft.Options{
+		ManualElection: true,
+	})
+
+	// TEST
+	// a crashed target never catches up, so the transfer runs until it times out
+	servers[2].Crash()
+	servers[0].SetLeader()
+	if _, err := servers[0].Propose(context.Background(), []byte("command1")); err != nil {
+		t.Fatalf("Propose failed: %v", err)
+	}
+	transferred := make(chan bool, 1)
+	go func() {
+		success, _ := servers[0].TransferLeadership(context.Background(), &raft.ClusterMember{ServerId: 2})
+		transferred <- success != nil && success.Flag
+	}()
+	time.Sleep(raft.TRANSFER_TIMEOUT / 4)
+
+	if _, err := servers[0].TransferLeadership(context.Background(), &raft.ClusterMember{ServerId: 1}); err != raft.ERR_TRANSFER_IN_PROGRESS {
+		t.Fatalf("Second transfer should have been refused with ERR_TRANSFER_IN_PROGRESS, got %v", err)
+	}
+	if <-transferred {
+		t.Fatalf("Transfer to a crashed server should have failed")
+	}
+}
+
+func TestRaftTransferStopsWhenCancelled(t *testing.T) {
+	//Setup
+	servers, _ := startFSMCluster(t, raft.NewInmemNetwork(), []string{"fsm0", "fsm1", "fsm2"}, raft.Options{
+		ManualElection: true,
+	})
+
+	// TEST
+	servers[2].Crash()
+	servers[0].SetLeader()
+	if _, err := servers[0].Propose(context.Background(), []byte("command1")); err != nil {
+		t.Fatalf("Propose failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(raft.TRANSFER_TIMEOUT/4, cancel)
+	start := time.Now()
+	_, err := servers[0].TransferLeadership(ctx, &raft.ClusterMember{ServerId: 2})
+	if status.Code(err) != codes.Canceled {
+		t.Fatalf("Cancelled transfer should fail with Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= raft.TRANSFER_TIMEOUT {
+		t.Fatalf("Cancelled transfer ran for %v", elapsed)
+	}
+
+	// writes are accepted again right away
+	proposeCtx, proposeCancel := context.WithTimeout(context.Background(), raft.TRANSFER_TIMEOUT/2)
+	defer proposeCancel()
+	if _, err := servers[0].Propose(proposeCtx, []byte("command2")); err != nil {
+		t.Fatalf("Propose after the cancelled transfer failed: %v", err)
+	}
+}
+
+func TestRaftFastLogBacktrackingOverOlderTerm(t *testing.T) {
+	//Setup
+	ips := []string{"fsm0", "fsm1", "fsm2"}
+	network := raft.NewInmemNetwork()
+	var mutex sync.Mutex
+	appends := 0
+	network.SetFilter(func(ctx context.Context, from, to string) error {
+		if from == "fsm2" && to == "fsm0" {
+			mutex.Lock()
+			appends++
+			mutex.Unlock()
+		}
+		return nil
+	})
+	servers, _ := startFSMCluster(t, network, ips, raft.Options{
+		ManualElection: true,
+	})
+
+	// TEST
+	servers[0].SetLeader()
+	if _, err := servers[0].Propose(context.Background(), []byte("command0")); err != nil {
+		t.Fatalf("Propose failed: %v", err)
+	}
+	// every server is in term 1 before the others take over
+	servers[0].SendHeartbeat()
+
+	// server 0 keeps hundreds of entries from term 1 that never commit
+	servers[1].Crash()
+	servers[2].Crash()
+	proposeAll(t, servers[0], "uncommitted", false)
+
+	// server 1 writes over them in term 2, and server 2 takes over in term 3
+	servers[0].Crash()
+	servers[1].Restore()
+	servers[2].Restore()
+	servers[1].SetLeader()
+	proposeAll(t, servers[1], "term2-", true)
+	servers[2].SetLeader()
+	if _, err := servers[2].Propose(context.Background(), []byte("command3")); err != nil {
+		t.Fatalf("Propose failed: %v", err)
+	}
+
+	// server 0's log diverges from the leader's for hundreds of entries, but
+	// the conflict hints skip all of term 2 at once
+	mutex.Lock()
+	appends = 0
+	mutex.Unlock()
+	servers[0].Restore()
+	for deadline := time.Now().Add(5 * time.Second); !sameRaftLog(servers[0].State().Log, servers[2].State().Log); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Server 0's log never converged with the leader's")
+		}
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if appends > 10 {
+		t.Fatalf("Server 0 took %d AppendEntries to converge", appends)
+	}
+}
+
+// Proposes 200 commands to server at once. If they must commit, fails the
+// test unless all of them did, otherwise gives up on them once they are in
+// its log.
+func proposeAll(t *testing.T, server *raft.Server, prefix string, commit bool) {
+	start := server.ClusterStatus().LastLogIndex
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := make(chan error, 200)
+	for i := 1; i <= 200; i++ {
+		go func(command string) {
+			_, err := server.Propose(ctx, []byte(command))
+			errs <- err
+		}(prefix + strconv.Itoa(i))
+	}
+	if !commit {
+		for deadline := time.Now().Add(5 * time.Second); server.ClusterStatus().LastLogIndex < start+200; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("The commands were never appended")
+			}
+		}
+		cancel()
+	}
+	for i := 0; i < 200; i++ {
+		if err := <-errs; err != nil && commit {
+			t.Fatalf("Propose failed: %v", err)
+		}
+	}
+}
+
+func sameRaftLog(log1, log2 []*raft.LogEntry) bool {
+	if len(log1) != len(log2) {
+		return false
+	}
+	for idx := range log1 {
+		if !proto.Equal(log1[idx], log2[idx]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,206 @@
+package SurfTest
+
+import (
+	"cse224/proj5/pkg/raft"
+	"flag"
+	"fmt"
+	"reflect"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+var simSeed = flag.Int64("sim.seed", 0, "run only the simulated schedule with this seed")
+var simSchedules = flag.Int("sim.schedules", 100, "number of simulated schedules to run")
+
+// Runs randomized schedules of crashes, partitions and updates against an
+// in-process cluster, then heals everything and checks that:
+// - no term ever had two leaders
+// - every server ends up with the same log and MetaStore, once the final
+// leader appended an entry
+// - every update a leader acknowledged survived
+func TestRaftSimRandomSchedules(t *testing.T) {
+	seeds := make([]int64, 0, *simSchedules)
+	if *simSeed != 0 {
+		seeds = append(seeds, *simSeed)
+	} else {
+		for seed := int64(1); seed <= int64(*simSchedules); seed++ {
+			seeds = append(seeds, seed)
+		}
+	}
+
+	// schedules share nothing, so they run side by side, one per CPU
+	errs := make([]error, len(seeds))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for worker := 0; worker < runtime.GOMAXPROCS(0); worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range next {
+				_, errs[idx] = runSimSchedule(seeds[idx])
+			}
+		}()
+	}
+	for idx := range seeds {
+		next <- idx
+	}
+	close(next)
+	wg.Wait()
+
+	for idx, err := range errs {
+		if err != nil {
+			t.Fatalf("Schedule with seed %d failed: %v (rerun with -sim.seed=%d)", seeds[idx], err, seeds[idx])
+		}
+	}
+}
+
+// Runs the same schedules twice and checks that every server went through
+// the same terms, leaderships and log lengths both times
+func TestRaftSimReplaysSeed(t *testing.T) {
+	for _, seed := range []int64{5, 14} {
+		first, err := runSimSchedule(seed)
+		if err != nil {
+			t.Fatalf("Schedule with seed %d failed: %v", seed, err)
+		}
+		second, err := runSimSchedule(seed)
+		if err != nil {
+			t.Fatalf("Schedule with seed %d failed on the second run: %v", seed, err)
+		}
+		if len(first) != len(second) {
+			t.Fatalf("Seed %d ran %d steps, then %d", seed, len(first), len(second))
+		}
+		for step := range first {
+			if !reflect.DeepEqual(first[step], second[step]) {
+				t.Fatalf("Seed %d diverged at step %d: %+v, then %+v", seed, step, first[step], second[step])
+			}
+		}
+	}
+}
+
+// What a server looked like after a step of a schedule
+type simServerTrace struct {
+	Term     int64
+	IsLeader bool
+	LogSize  int
+}
+
+// Every server after a step of a schedule
+type simTrace []simServerTrace
+
+func traceOf(states []*raft.State) simTrace {
+	trace := make(simTrace, len(states))
+	for idx, state := range states {
+		trace[idx] = simServerTrace{Term: state.Term, IsLeader: state.IsLeader, LogSize: len(state.Log)}
+	}
+	return trace
+}
+
+// Runs the schedule drawn from seed and returns its trace, one entry per step
+func runSimSchedule(seed int64) ([]simTrace, error) {
+	cluster := NewSimCluster(seed, 3+2*int(seed%2))
+	defer cluster.Close()
+	random := cluster.Rand
+
+	var trace []simTrace
+	leaders := make(map[int64]int)
+	checkLeaders := func() error {
+		states := cluster.States()
+		trace = append(trace, traceOf(states))
+		for idx, state := range states {
+			if !state.IsLeader {
+				continue
+			}
+			if leader, ok := leaders[state.Term]; ok && leader != idx {
+				return fmt.Errorf("servers %d and %d both lead term %d", leader, idx, state.Term)
+			}
+			leaders[state.Term] = idx
+		}
+		return nil
+	}
+
+	// updates still waiting for their result, in the order they were made
+	var pending []*SimUpdate
+	acknowledged := make(map[string]bool)
+	updates := 0
+	update := func(idx int) {
+		pending = append(pending, cluster.Update(idx, "testFile"+strconv.Itoa(updates)))
+		updates++
+	}
+	collect := func() {
+		waiting := pending[:0]
+		for _, update := range pending {
+			if result := update.Result(); result == nil {
+				waiting = append(waiting, update)
+			} else if result.Err == nil {
+				acknowledged[update.Filename] = true
+			}
+		}
+		pending = waiting
+	}
+
+	for step := 0; step < 30; step++ {
+		switch event := random.Intn(10); {
+		case event < 2:
+			cluster.Crash(random.Intn(len(cluster.Servers)))
+		case event < 4:
+			cluster.Restore(random.Intn(len(cluster.Servers)))
+		case event < 5:
+			order := random.Perm(len(cluster.Servers))
+			split := 1 + random.Intn(len(order)-1)
+			cluster.Partition(order[:split], order[split:])
+		case event < 6:
+			cluster.Heal()
+		default:
+			// clients mostly find a server that believes it leads
+			idx := random.Intn(len(cluster.Servers))
+			if leader := cluster.Leader(); leader != -1 && random.Intn(4) > 0 {
+				idx = leader
+			}
+			update(idx)
+		}
+
+		cluster.Advance(time.Duration(50+random.Intn(250)) * time.Millisecond)
+		collect()
+		if err := checkLeaders(); err != nil {
+			return trace, err
+		}
+	}
+
+	// with every server back and connected, the cluster must converge
+	cluster.Heal()
+	for idx := range cluster.Servers {
+		cluster.Restore(idx)
+	}
+	cluster.Advance(3 * time.Second)
+	if err := checkLeaders(); err != nil {
+		return trace, err
+	}
+	// an entry from the final leader's term replaces whatever uncommitted
+	// entries followers still hold
+	leader := cluster.Leader()
+	if leader == -1 {
+		return trace, fmt.Errorf("no leader after healing")
+	}
+	update(leader)
+	cluster.Advance(time.Second)
+	collect()
+
+	states := cluster.InternalStates()
+	for idx, state := range states {
+		if !SameLog(states[0].Log, state.Log) {
+			return trace, fmt.Errorf("log of server %d differs from server 0's", idx)
+		}
+		if !SameMeta(states[0].MetaMap.FileInfoMap, state.MetaMap.FileInfoMap) {
+			return trace, fmt.Errorf("MetaStore of server %d differs from server 0's", idx)
+		}
+	}
+	for filename := range acknowledged {
+		if _, ok := states[0].MetaMap.FileInfoMap[filename]; !ok {
+			return trace, fmt.Errorf("acknowledged update of %s was lost", filename)
+		}
+	}
+	return trace, nil
+}
@@ -0,0 +1,182 @@
+package SurfTest
+
+import (
+	context "context"
+	"cse224/proj5/pkg/raft"
+	"cse224/proj5/pkg/surfstore"
+	"fmt"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+	"math/rand"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// A cluster of servers running in this process on a simulated clock, talking
+// over an InmemNetwork instead of gRPC. The servers' timers, RPCs and
+// applies are all events on the clock, which the harness runs one at a time
+// on its own goroutine, so the election timeouts, faults and message order
+// all come from Seed and rerunning a seed replays the same schedule.
+type SimCluster struct {
+	Seed    int64
+	Clock   *raft.SimulatedClock
+	Ips     []string
+	Servers []*surfstore.RaftSurfstore
+	Rand    *rand.Rand
+
+	// Messages from one server to another that are lost
+	blocked map[[2]int]bool
+}
+
+// An update handed to a server, see SimCluster.Update
+type SimUpdate struct {
+	Filename string
+	result   <-chan *raft.ProposalResult
+}
+
+func NewSimCluster(seed int64, size int) *SimCluster {
+	cluster := &SimCluster{
+		Seed:    seed,
+		Clock:   raft.NewSimulatedClock(time.Unix(0, 0), seed),
+		Ips:     make([]string, size),
+		Servers: make([]*surfstore.RaftSurfstore, size),
+		Rand:    rand.New(rand.NewSource(seed)),
+		blocked: make(map[[2]int]bool),
+	}
+	for idx := range cluster.Ips {
+		cluster.Ips[idx] = fmt.Sprintf("sim%d", idx)
+	}
+	network := raft.NewInmemNetwork()
+	network.SetFilter(cluster.filter)
+	for idx, ip := range cluster.Ips {
+		server, err := surfstore.NewRaftServer(int64(idx), cluster.Ips, "", surfstore.RaftServerOptions{
+			Transport: network.Transport(ip),
+			Clock:     cluster.Clock,
+			Seed:      seed*int64(size) + int64(idx) + 1,
+		})
+		if err != nil {
+			panic(err)
+		}
+		network.Register(ip, server.Raft())
+		cluster.Servers[idx] = server
+	}
+	for _, server := range cluster.Servers {
+		surfstore.StartRaftServer(server)
+	}
+	return cluster
+}
+
+func (c *SimCluster) Close() {
+	for _, server := range c.Servers {
+		surfstore.StopRaftServer(server)
+	}
+	c.Heal()
+	// let anything waiting on a timer give up
+	c.Advance(time.Second)
+}
+
+// Moves the simulated clock forward by d, running every event that falls
+// due on the way
+func (c *SimCluster) Advance(d time.Duration) {
+	c.Clock.Advance(d)
+}
+
+// Hands an update of filename to server idx without waiting for it to
+// commit, which Advance lets happen
+func (c *SimCluster) Update(idx int, filename string) *SimUpdate {
+	command, err := proto.Marshal(&surfstore.FileMetaData{Filename: filename, Version: 1})
+	if err != nil {
+		panic(err)
+	}
+	return &SimUpdate{
+		Filename: filename,
+		result:   c.Servers[idx].Raft().ProposeAsync(command),
+	}
+}
+
+// The outcome of the update at the server it was handed to, nil while it is
+// still pending. Only reports it once.
+func (u *SimUpdate) Result() *raft.ProposalResult {
+	select {
+	case result := <-u.result:
+		return result
+	default:
+		return nil
+	}
+}
+
+func (c *SimCluster) Crash(idx int) {
+	c.Servers[idx].Crash(context.Background(), &emptypb.Empty{})
+}
+
+func (c *SimCluster) Restore(idx int) {
+	c.Servers[idx].Restore(context.Background(), &emptypb.Empty{})
+}
+
+// Splits the servers into groups that only reach servers in their own group
+func (c *SimCluster) Partition(groups ...[]int) {
+	for i, group := range groups {
+		for j, other := range groups {
+			if i == j {
+				continue
+			}
+			for _, from := range group {
+				for _, to := range other {
+					c.blocked[[2]int{from, to}] = true
+				}
+			}
+		}
+	}
+}
+
+// Delivers every message again
+func (c *SimCluster) Heal() {
+	c.blocked = make(map[[2]int]bool)
+}
+
+// The Raft state of every server
+func (c *SimCluster) States() []*raft.State {
+	states := make([]*raft.State, len(c.Servers))
+	for idx, server := range c.Servers {
+		states[idx] = server.Raft().State()
+	}
+	return states
+}
+
+// The state of every server, as GetInternalState reports it
+func (c *SimCluster) InternalStates() []*surfstore.RaftInternalState {
+	states := make([]*surfstore.RaftInternalState, len(c.Servers))
+	for idx, server := range c.Servers {
+		states[idx], _ = server.GetInternalState(context.Background(), &emptypb.Empty{})
+	}
+	return states
+}
+
+// A server that isn't crashed and believes it leads, -1 if there is none
+func (c *SimCluster) Leader() int {
+	for idx, state := range c.States() {
+		if state.IsLeader && !c.Servers[idx].Raft().IsCrashed() {
+			return idx
+		}
+	}
+	return -1
+}
+
+func (c *SimCluster) indexOf(addr string) int {
+	for idx, ip := range c.Ips {
+		if ip == addr {
+			return idx
+		}
+	}
+	panic("unknown server " + addr)
+}
+
+// Loses messages between servers that are partitioned from each other
+func (c *SimCluster) filter(ctx context.Context, from, to string) error {
+	if c.blocked[[2]int{c.indexOf(from), c.indexOf(to)}] {
+		return status.Errorf(codes.Unavailable, "%s is partitioned from %s", from, to)
+	}
+	return nil
+}
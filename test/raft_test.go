@@ -1,9 +1,16 @@
 package SurfTest
 
 import (
+	context "context"
+	"cse224/proj5/pkg/raft"
 	"cse224/proj5/pkg/surfstore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 	emptypb "google.golang.org/protobuf/types/known/emptypb"
+	"strconv"
 	"testing"
+	"time"
 )
 
 func TestRaftSetLeader(t *testing.T) {
@@ -116,3 +123,1062 @@ func TestRaftFollowersGetUpdates(t *testing.T) {
 		}
 	}
 }
+
+func TestRaftLeaderElection(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitElectionTest(cfgPath, "8080")
+	defer EndTest(test)
+
+	// TEST
+	leaderIdx := WaitForLeader(test, 5*time.Second)
+	if leaderIdx == -1 {
+		t.Fatalf("No leader was elected")
+	}
+
+	// no two servers may lead in the same term
+	leaders := make(map[int64]int)
+	for idx, server := range test.Clients {
+		state, _ := server.GetInternalState(test.Context, &emptypb.Empty{})
+		if !state.IsLeader {
+			continue
+		}
+		if other, ok := leaders[state.Term]; ok {
+			t.Fatalf("Servers %d and %d are both leaders in term %d", other, idx, state.Term)
+		}
+		leaders[state.Term] = idx
+	}
+
+	// a new leader should take over once the old one crashes
+	test.Clients[leaderIdx].Crash(test.Context, &emptypb.Empty{})
+	newLeaderIdx := WaitForLeader(test, 5*time.Second)
+	if newLeaderIdx == -1 || newLeaderIdx == leaderIdx {
+		t.Fatalf("No new leader was elected after server %d crashed", leaderIdx)
+	}
+}
+
+func TestRaftBackgroundHeartbeat(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitElectionTest(cfgPath, "8080")
+	defer EndTest(test)
+
+	// TEST
+	leaderIdx := WaitForLeader(test, 5*time.Second)
+	if leaderIdx == -1 {
+		t.Fatalf("No leader was elected")
+	}
+	state, _ := test.Clients[leaderIdx].GetInternalState(test.Context, &emptypb.Empty{})
+	leaderTerm := state.Term
+
+	filemeta1 := &surfstore.FileMetaData{
+		Filename:      "testFile1",
+		Version:       1,
+		BlockHashList: nil,
+	}
+	test.Clients[leaderIdx].UpdateFile(test.Context, filemeta1)
+
+	// heartbeats alone should keep the leader in place and spread the commit
+	time.Sleep(2 * time.Second)
+
+	goldenMeta := surfstore.NewMetaStore("")
+	goldenMeta.UpdateFile(test.Context, filemeta1)
+
+	for idx, server := range test.Clients {
+		state, _ := server.GetInternalState(test.Context, &emptypb.Empty{})
+		if state.Term != leaderTerm {
+			t.Logf("Server %d should still be in term %d, got %d", idx, leaderTerm, state.Term)
+			t.Fail()
+		}
+		if state.IsLeader != (idx == leaderIdx) {
+			t.Logf("Server %d has the wrong leader state", idx)
+			t.Fail()
+		}
+		if !SameMeta(goldenMeta.FileMetaMap, state.MetaMap.FileInfoMap) {
+			t.Log(state.MetaMap.FileInfoMap)
+			t.Logf("MetaStore state of server %d is not correct", idx)
+			t.Fail()
+		}
+	}
+}
+
+func TestRaftLogsCatchUpAfterRestore(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitTest(cfgPath, "8080")
+	defer EndTest(test)
+
+	// TEST
+	leaderIdx := 0
+	test.Clients[leaderIdx].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[leaderIdx].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	goldenMeta := surfstore.NewMetaStore("")
+	goldenLog := make([]*surfstore.UpdateOperation, 0)
+	update := func(filemeta *surfstore.FileMetaData) {
+		test.Clients[leaderIdx].UpdateFile(test.Context, filemeta)
+		goldenMeta.UpdateFile(test.Context, filemeta)
+		goldenLog = append(goldenLog, &surfstore.UpdateOperation{
+			Term:         1,
+			FileMetaData: filemeta,
+		})
+	}
+
+	update(&surfstore.FileMetaData{Filename: "testFile1", Version: 1})
+
+	// server 2 misses the next updates
+	test.Clients[2].Crash(test.Context, &emptypb.Empty{})
+	update(&surfstore.FileMetaData{Filename: "testFile2", Version: 1})
+	update(&surfstore.FileMetaData{Filename: "testFile1", Version: 2})
+	update(&surfstore.FileMetaData{Filename: "testFile3", Version: 1})
+	test.Clients[2].Restore(test.Context, &emptypb.Empty{})
+
+	// repeated heartbeats must not duplicate entries
+	for i := 0; i < 3; i++ {
+		test.Clients[leaderIdx].SendHeartbeat(test.Context, &emptypb.Empty{})
+	}
+
+	for idx, server := range test.Clients {
+		state, _ := server.GetInternalState(test.Context, &emptypb.Empty{})
+		if !SameLog(goldenLog, state.Log) {
+			t.Log(state.Log)
+			t.Logf("Log of server %d does not match", idx)
+			t.Fail()
+		}
+		if !SameMeta(goldenMeta.FileMetaMap, state.MetaMap.FileInfoMap) {
+			t.Log(state.MetaMap.FileInfoMap)
+			t.Logf("MetaStore state of server %d is not correct", idx)
+			t.Fail()
+		}
+	}
+}
+
+func TestRaftFastLogBacktracking(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitTest(cfgPath, "8080")
+	defer EndTest(test)
+
+	// TEST
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	goldenMeta := surfstore.NewMetaStore("")
+	filemeta := &surfstore.FileMetaData{Filename: "testFile0", Version: 1}
+	test.Clients[0].UpdateFile(test.Context, filemeta)
+	goldenMeta.UpdateFile(test.Context, filemeta)
+
+	// server 2 misses hundreds of updates
+	test.Clients[2].Crash(test.Context, &emptypb.Empty{})
+	for i := 1; i <= 300; i++ {
+		filemeta := &surfstore.FileMetaData{Filename: "testFile" + strconv.Itoa(i), Version: 1}
+		test.Clients[0].UpdateFile(test.Context, filemeta)
+		goldenMeta.UpdateFile(test.Context, filemeta)
+	}
+
+	// a new leader starts with nextIndex at the end of its log, so it has to
+	// find where server 2's log ends
+	test.Clients[1].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[1].SendHeartbeat(test.Context, &emptypb.Empty{})
+	test.Clients[2].Restore(test.Context, &emptypb.Empty{})
+
+	// one round to learn the conflict, one to catch up
+	test.Clients[1].SendHeartbeat(test.Context, &emptypb.Empty{})
+	test.Clients[1].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	leaderState, _ := test.Clients[1].GetInternalState(test.Context, &emptypb.Empty{})
+	state, _ := test.Clients[2].GetInternalState(test.Context, &emptypb.Empty{})
+	if !SameLog(leaderState.Log, state.Log) {
+		t.Fatalf("Server 2 has %d log entries, the leader has %d", len(state.Log), len(leaderState.Log))
+	}
+	if !SameMeta(goldenMeta.FileMetaMap, state.MetaMap.FileInfoMap) {
+		t.Fatalf("MetaStore state of server 2 is not correct")
+	}
+}
+
+func TestRaftStateSurvivesRestart(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitDurableTest(cfgPath, "8080", t.TempDir())
+	defer EndTest(test)
+
+	// TEST
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	goldenMeta := surfstore.NewMetaStore("")
+	goldenLog := make([]*surfstore.UpdateOperation, 0)
+	for i := 1; i <= 3; i++ {
+		filemeta := &surfstore.FileMetaData{Filename: "testFile" + strconv.Itoa(i), Version: 1}
+		test.Clients[0].UpdateFile(test.Context, filemeta)
+		goldenMeta.UpdateFile(test.Context, filemeta)
+		goldenLog = append(goldenLog, &surfstore.UpdateOperation{Term: 1, FileMetaData: filemeta})
+	}
+
+	for idx := range test.Clients {
+		RestartRaftServer(test, idx)
+	}
+
+	// term and log come back from the write-ahead log
+	for idx, server := range test.Clients {
+		state, _ := server.GetInternalState(test.Context, &emptypb.Empty{})
+		if state.Term != 1 {
+			t.Fatalf("Server %d should be in term 1 after restart, got %d", idx, state.Term)
+		}
+		if !SameLog(goldenLog, state.Log) {
+			t.Fatalf("Log of server %d was not recovered", idx)
+		}
+	}
+
+	// the MetaStore is rebuilt once a new leader commits again
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	for idx, server := range test.Clients {
+		state, _ := server.GetInternalState(test.Context, &emptypb.Empty{})
+		if !SameMeta(goldenMeta.FileMetaMap, state.MetaMap.FileInfoMap) {
+			t.Log(state.MetaMap.FileInfoMap)
+			t.Logf("MetaStore state of server %d is not correct", idx)
+			t.Fail()
+		}
+	}
+}
+
+func TestRaftSnapshotCatchUp(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitTestWithArgs(cfgPath, "8080", "-manual", "-snapshot-threshold", "50", "-data-dir", t.TempDir())
+	defer EndTest(test)
+
+	// TEST
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	goldenMeta := surfstore.NewMetaStore("")
+	filemeta := &surfstore.FileMetaData{Filename: "testFile0", Version: 1}
+	test.Clients[0].UpdateFile(test.Context, filemeta)
+	goldenMeta.UpdateFile(test.Context, filemeta)
+
+	// server 2 falls behind the leader's snapshot
+	test.Clients[2].Crash(test.Context, &emptypb.Empty{})
+	for i := 1; i <= 200; i++ {
+		filemeta := &surfstore.FileMetaData{Filename: "testFile" + strconv.Itoa(i%20), Version: int32(i/20 + 1)}
+		test.Clients[0].UpdateFile(test.Context, filemeta)
+		goldenMeta.UpdateFile(test.Context, filemeta)
+	}
+
+	leaderState, _ := test.Clients[0].GetInternalState(test.Context, &emptypb.Empty{})
+	if len(leaderState.Log) >= 50 {
+		t.Fatalf("Leader log should have been compacted, it has %d entries", len(leaderState.Log))
+	}
+
+	test.Clients[2].Restore(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	state, _ := test.Clients[2].GetInternalState(test.Context, &emptypb.Empty{})
+	if !SameMeta(goldenMeta.FileMetaMap, state.MetaMap.FileInfoMap) {
+		t.Fatalf("MetaStore state of server 2 is not correct after installing the snapshot")
+	}
+
+	// the snapshot and compacted log survive a restart
+	RestartRaftServer(test, 2)
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	leaderState, _ = test.Clients[0].GetInternalState(test.Context, &emptypb.Empty{})
+	state, _ = test.Clients[2].GetInternalState(test.Context, &emptypb.Empty{})
+	if !SameMeta(goldenMeta.FileMetaMap, state.MetaMap.FileInfoMap) {
+		t.Fatalf("MetaStore state of server 2 is not correct after restart")
+	}
+	if len(state.Log) > len(leaderState.Log) {
+		t.Fatalf("Server 2 should hold at most the leader's %d entries, it has %d", len(leaderState.Log), len(state.Log))
+	}
+}
+
+func TestRaftFollowerRedirectsToLeader(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitTest(cfgPath, "8080")
+	defer EndTest(test)
+
+	// TEST
+	test.Clients[1].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[1].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	addrs := surfstore.LoadRaftConfigFile(cfgPath)
+	filemeta := &surfstore.FileMetaData{Filename: "testFile1", Version: 1}
+	_, err := test.Clients[2].UpdateFile(test.Context, filemeta)
+	leaderAddr, notLeader := surfstore.LeaderAddrFromError(err)
+	if !notLeader || leaderAddr != addrs[1] {
+		t.Fatalf("Follower should name %s as the leader, got %v", addrs[1], err)
+	}
+
+	// the client starts with a follower and is sent on to the leader
+	client := surfstore.NewSurfstoreRPCClient([]string{addrs[2], addrs[0], addrs[1]}, "", BLOCK_SIZE)
+	var version int32
+	if err := client.UpdateFile(filemeta, &version); err != nil || version != 1 {
+		t.Fatalf("Update through a follower failed: %v", err)
+	}
+	var fileInfoMap map[string]*surfstore.FileMetaData
+	if err := client.GetFileInfoMap(&fileInfoMap); err != nil {
+		t.Fatalf("GetFileInfoMap through a follower failed: %v", err)
+	}
+	if fileInfoMap["testFile1"] == nil || fileInfoMap["testFile1"].Version != 1 {
+		t.Fatalf("Leader should have testFile1 at version 1")
+	}
+
+	// after a new leader takes over, the old one redirects as well
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+	filemeta = &surfstore.FileMetaData{Filename: "testFile1", Version: 2}
+	if err := client.UpdateFile(filemeta, &version); err != nil || version != 2 {
+		t.Fatalf("Update after the leader changed failed: %v", err)
+	}
+}
+
+func TestRaftReadFailsWithoutQuorum(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitTest(cfgPath, "8080")
+	defer EndTest(test)
+
+	// TEST
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	filemeta := &surfstore.FileMetaData{Filename: "testFile1", Version: 1}
+	test.Clients[0].UpdateFile(test.Context, filemeta)
+
+	test.Clients[1].Crash(test.Context, &emptypb.Empty{})
+	test.Clients[2].Crash(test.Context, &emptypb.Empty{})
+
+	start := time.Now()
+	_, err := test.Clients[0].GetFileInfoMap(test.Context, &emptypb.Empty{})
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("Read without a majority should be unavailable, got %v", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Fatalf("Read without a majority took %v to fail", time.Since(start))
+	}
+
+	test.Clients[1].Restore(test.Context, &emptypb.Empty{})
+	fileInfoMap, err := test.Clients[0].GetFileInfoMap(test.Context, &emptypb.Empty{})
+	if err != nil {
+		t.Fatalf("Read with a majority failed: %v", err)
+	}
+	if fileInfoMap.FileInfoMap["testFile1"] == nil {
+		t.Fatalf("Read should see testFile1")
+	}
+}
+
+func TestRaftLeaseReadsRefusedAfterExpiry(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitTestWithArgs(cfgPath, "8080", "-manual", "-lease-reads")
+	defer EndTest(test)
+
+	// TEST
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	filemeta := &surfstore.FileMetaData{Filename: "testFile1", Version: 1}
+	test.Clients[0].UpdateFile(test.Context, filemeta)
+
+	// cut the leader off from both followers right after they acknowledged it
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+	test.Clients[1].Crash(test.Context, &emptypb.Empty{})
+	test.Clients[2].Crash(test.Context, &emptypb.Empty{})
+
+	// within the lease the read is served locally
+	fileInfoMap, err := test.Clients[0].GetFileInfoMap(test.Context, &emptypb.Empty{})
+	if err != nil {
+		t.Fatalf("Read within the lease failed: %v", err)
+	}
+	if fileInfoMap.FileInfoMap["testFile1"] == nil {
+		t.Fatalf("Read within the lease should see testFile1")
+	}
+
+	// once it runs out the leader can no longer vouch for its state
+	time.Sleep(raft.LEASE_DURATION)
+	_, err = test.Clients[0].GetFileInfoMap(test.Context, &emptypb.Empty{})
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("Read after the lease expired should be refused, got %v", err)
+	}
+}
+
+func TestRaftGrowClusterToFiveNodes(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3nodes.txt"
+	bigCfgPath := "./config_files/5nodes.txt"
+	test := InitTest(cfgPath, "8080")
+	defer func() { EndTest(test) }()
+
+	// TEST
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	goldenMeta := surfstore.NewMetaStore("")
+	filemeta1 := &surfstore.FileMetaData{Filename: "testFile1", Version: 1}
+	test.Clients[0].UpdateFile(test.Context, filemeta1)
+	goldenMeta.UpdateFile(test.Context, filemeta1)
+
+	test = JoinRaftServers(test, bigCfgPath)
+	for _, idx := range []string{"3", "4"} {
+		if err := RunAdmin("add", "-f", bigCfgPath, "-i", idx); err != nil {
+			t.Fatalf("Adding server %s failed: %v", idx, err)
+		}
+	}
+	state, _ := test.Clients[0].GetInternalState(test.Context, &emptypb.Empty{})
+	if len(state.Configuration.Members) != 5 {
+		t.Fatalf("Cluster should have 5 members, has %d", len(state.Configuration.Members))
+	}
+
+	// the leader and the two new servers are now a majority
+	test.Clients[1].Crash(test.Context, &emptypb.Empty{})
+	test.Clients[2].Crash(test.Context, &emptypb.Empty{})
+	filemeta2 := &surfstore.FileMetaData{Filename: "testFile2", Version: 1}
+	ctx, cancel := context.WithTimeout(test.Context, 2*time.Second)
+	defer cancel()
+	if _, err := test.Clients[0].UpdateFile(ctx, filemeta2); err != nil {
+		t.Fatalf("Update with the new servers as majority failed: %v", err)
+	}
+	goldenMeta.UpdateFile(test.Context, filemeta2)
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	leaderState, _ := test.Clients[0].GetInternalState(test.Context, &emptypb.Empty{})
+	for _, idx := range []int{3, 4} {
+		state, _ := test.Clients[idx].GetInternalState(test.Context, &emptypb.Empty{})
+		if !SameLog(leaderState.Log, state.Log) {
+			t.Fatalf("Log of new server %d does not match the leader", idx)
+		}
+		if !SameMeta(goldenMeta.FileMetaMap, state.MetaMap.FileInfoMap) {
+			t.Fatalf("MetaStore state of new server %d is not correct", idx)
+		}
+	}
+
+	// shrink back down by one
+	test.Clients[1].Restore(test.Context, &emptypb.Empty{})
+	test.Clients[2].Restore(test.Context, &emptypb.Empty{})
+	if err := RunAdmin("remove", "-f", bigCfgPath, "-i", "4"); err != nil {
+		t.Fatalf("Removing server 4 failed: %v", err)
+	}
+	state, _ = test.Clients[0].GetInternalState(test.Context, &emptypb.Empty{})
+	if len(state.Configuration.Members) != 4 {
+		t.Fatalf("Cluster should have 4 members, has %d", len(state.Configuration.Members))
+	}
+}
+
+func TestRaftLearnerExcludedFromQuorum(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/4nodes_learner.txt"
+	test := InitTest(cfgPath, "8080")
+	defer EndTest(test)
+
+	// TEST
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	goldenMeta := surfstore.NewMetaStore("")
+	filemeta1 := &surfstore.FileMetaData{Filename: "testFile1", Version: 1}
+	test.Clients[0].UpdateFile(test.Context, filemeta1)
+	goldenMeta.UpdateFile(test.Context, filemeta1)
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	// the learner applies the log like any follower
+	state, _ := test.Clients[3].GetInternalState(test.Context, &emptypb.Empty{})
+	if !SameMeta(goldenMeta.FileMetaMap, state.MetaMap.FileInfoMap) {
+		t.Fatalf("MetaStore state of the learner is not correct")
+	}
+
+	// but the leader and the learner are no majority of the 3 voters
+	test.Clients[1].Crash(test.Context, &emptypb.Empty{})
+	test.Clients[2].Crash(test.Context, &emptypb.Empty{})
+	filemeta2 := &surfstore.FileMetaData{Filename: "testFile2", Version: 1}
+	ctx, cancel := context.WithTimeout(test.Context, 500*time.Millisecond)
+	defer cancel()
+	if _, err := test.Clients[0].UpdateFile(ctx, filemeta2); err == nil {
+		t.Fatalf("Update should not commit with only the learner")
+	}
+	test.Clients[1].Restore(test.Context, &emptypb.Empty{})
+	test.Clients[2].Restore(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+	goldenMeta.UpdateFile(test.Context, filemeta2)
+
+	// once promoted it counts: 4 voters need 3
+	if err := RunAdmin("promote", "-f", cfgPath, "-i", "3"); err != nil {
+		t.Fatalf("Promoting the learner failed: %v", err)
+	}
+	state, _ = test.Clients[0].GetInternalState(test.Context, &emptypb.Empty{})
+	for _, member := range state.Configuration.Members {
+		if member.Learner {
+			t.Fatalf("Server %d should no longer be a learner", member.ServerId)
+		}
+	}
+
+	test.Clients[1].Crash(test.Context, &emptypb.Empty{})
+	filemeta3 := &surfstore.FileMetaData{Filename: "testFile3", Version: 1}
+	ctx, cancel = context.WithTimeout(test.Context, 2*time.Second)
+	defer cancel()
+	if _, err := test.Clients[0].UpdateFile(ctx, filemeta3); err != nil {
+		t.Fatalf("Update with the promoted learner in the majority failed: %v", err)
+	}
+	goldenMeta.UpdateFile(test.Context, filemeta3)
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	state, _ = test.Clients[3].GetInternalState(test.Context, &emptypb.Empty{})
+	if !SameMeta(goldenMeta.FileMetaMap, state.MetaMap.FileInfoMap) {
+		t.Fatalf("MetaStore state of the promoted learner is not correct")
+	}
+}
+
+func TestRaftTransferLeadership(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitTest(cfgPath, "8080")
+	defer EndTest(test)
+
+	// TEST
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	goldenMeta := surfstore.NewMetaStore("")
+	for i := 1; i <= 5; i++ {
+		filemeta := &surfstore.FileMetaData{Filename: "testFile" + strconv.Itoa(i), Version: 1}
+		test.Clients[0].UpdateFile(test.Context, filemeta)
+		goldenMeta.UpdateFile(test.Context, filemeta)
+	}
+
+	// server 2 is behind when the transfer starts
+	test.Clients[2].Crash(test.Context, &emptypb.Empty{})
+	filemeta := &surfstore.FileMetaData{Filename: "testFile6", Version: 1}
+	test.Clients[0].UpdateFile(test.Context, filemeta)
+	goldenMeta.UpdateFile(test.Context, filemeta)
+	test.Clients[2].Restore(test.Context, &emptypb.Empty{})
+
+	succ, err := test.Clients[0].TransferLeadership(test.Context, &raft.ClusterMember{ServerId: 2})
+	if err != nil || !succ.Flag {
+		t.Fatalf("Leadership transfer failed: %v", err)
+	}
+
+	oldState, _ := test.Clients[0].GetInternalState(test.Context, &emptypb.Empty{})
+	newState, _ := test.Clients[2].GetInternalState(test.Context, &emptypb.Empty{})
+	if oldState.IsLeader || !newState.IsLeader {
+		t.Fatalf("Server 2 should have taken over from server 0")
+	}
+	if !SameMeta(goldenMeta.FileMetaMap, newState.MetaMap.FileInfoMap) {
+		t.Fatalf("New leader is missing updates")
+	}
+
+	// the new leader accepts writes, the old one redirects them
+	filemeta = &surfstore.FileMetaData{Filename: "testFile7", Version: 1}
+	if _, err := test.Clients[2].UpdateFile(test.Context, filemeta); err != nil {
+		t.Fatalf("Update on the new leader failed: %v", err)
+	}
+	_, err = test.Clients[0].UpdateFile(test.Context, filemeta)
+	if leaderAddr, notLeader := surfstore.LeaderAddrFromError(err); !notLeader || leaderAddr != test.Ips[2] {
+		t.Fatalf("Old leader should redirect to server 2, got %v", err)
+	}
+}
+
+func TestRaftPreVoteKeepsLeaderAfterPartition(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitElectionTest(cfgPath, "8080")
+	defer EndTest(test)
+
+	// TEST
+	leaderIdx := WaitForLeader(test, 5*time.Second)
+	if leaderIdx == -1 {
+		t.Fatalf("No leader was elected")
+	}
+	state, _ := test.Clients[leaderIdx].GetInternalState(test.Context, &emptypb.Empty{})
+	term := state.Term
+
+	// the follower's election timer runs out while it is cut off, so it
+	// campaigns as soon as it is back
+	followerIdx := (leaderIdx + 1) % len(test.Clients)
+	PauseRaftServer(test, followerIdx)
+	time.Sleep(2 * time.Second)
+	ResumeRaftServer(test, followerIdx)
+	time.Sleep(2 * time.Second)
+
+	state, _ = test.Clients[leaderIdx].GetInternalState(test.Context, &emptypb.Empty{})
+	if !state.IsLeader || state.Term != term {
+		t.Fatalf("Leader should still lead in term %d, is leader: %v in term %d", term, state.IsLeader, state.Term)
+	}
+	state, _ = test.Clients[followerIdx].GetInternalState(test.Context, &emptypb.Empty{})
+	if state.Term != term {
+		t.Fatalf("Follower should have stayed in term %d, is in term %d", term, state.Term)
+	}
+}
+
+func TestRaftConcurrentUpdatesPipelined(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitDurableTest(cfgPath, "8080", t.TempDir())
+	defer EndTest(test)
+
+	// TEST
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	// a follower that misses the burst is caught up afterwards
+	test.Clients[2].Crash(test.Context, &emptypb.Empty{})
+
+	const updates = 200
+	goldenMeta := surfstore.NewMetaStore("")
+	errs := make(chan error, updates)
+	start := time.Now()
+	for i := 0; i < updates; i++ {
+		filemeta := &surfstore.FileMetaData{Filename: "testFile" + strconv.Itoa(i), Version: 1}
+		goldenMeta.UpdateFile(test.Context, filemeta)
+		go func() {
+			_, err := test.Clients[0].UpdateFile(test.Context, filemeta)
+			errs <- err
+		}()
+	}
+	for i := 0; i < updates; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("Update failed: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Concurrent updates took %v", elapsed)
+	}
+
+	test.Clients[2].Restore(test.Context, &emptypb.Empty{})
+	time.Sleep(time.Second)
+
+	leaderState, _ := test.Clients[0].GetInternalState(test.Context, &emptypb.Empty{})
+	if len(leaderState.Log) != updates {
+		t.Fatalf("Leader should hold %d entries, has %d", updates, len(leaderState.Log))
+	}
+	for idx, server := range test.Clients {
+		state, _ := server.GetInternalState(test.Context, &emptypb.Empty{})
+		if !SameLog(leaderState.Log, state.Log) {
+			t.Fatalf("Log of server %d differs from the leader's", idx)
+		}
+		if !SameMeta(goldenMeta.FileMetaMap, state.MetaMap.FileInfoMap) {
+			t.Fatalf("MetaStore state of server %d is not correct", idx)
+		}
+	}
+}
+
+func TestRaftLeaderReconnectsToRestartedFollower(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitDurableTest(cfgPath, "8080", t.TempDir())
+	defer EndTest(test)
+
+	// TEST
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	goldenMeta := surfstore.NewMetaStore("")
+	filemeta := &surfstore.FileMetaData{Filename: "testFile1", Version: 1}
+	test.Clients[0].UpdateFile(test.Context, filemeta)
+	goldenMeta.UpdateFile(test.Context, filemeta)
+
+	// the leader's connection to server 1 breaks, and server 1 is the only
+	// follower left to commit with
+	RestartRaftServer(test, 1)
+	test.Clients[2].Crash(test.Context, &emptypb.Empty{})
+
+	filemeta = &surfstore.FileMetaData{Filename: "testFile2", Version: 1}
+	ctx, cancel := context.WithTimeout(test.Context, 2*time.Second)
+	defer cancel()
+	if _, err := test.Clients[0].UpdateFile(ctx, filemeta); err != nil {
+		t.Fatalf("Update after the follower restarted failed: %v", err)
+	}
+	goldenMeta.UpdateFile(test.Context, filemeta)
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	state, _ := test.Clients[1].GetInternalState(test.Context, &emptypb.Empty{})
+	if !SameMeta(goldenMeta.FileMetaMap, state.MetaMap.FileInfoMap) {
+		t.Fatalf("Restarted follower is missing updates")
+	}
+}
+
+func TestRaftRaceConcurrentUpdatesAndAppends(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitTest(cfgPath, "8080")
+	defer EndTest(test)
+
+	// TEST
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	// updates on the leader race with stale AppendEntries sent straight to
+	// the followers, reads and inspection of every server
+	const updates = 100
+	done := make(chan error, 4*updates)
+	for i := 0; i < updates; i++ {
+		filemeta := &surfstore.FileMetaData{Filename: "testFile" + strconv.Itoa(i), Version: 1}
+		go func() {
+			_, err := test.Clients[0].UpdateFile(test.Context, filemeta)
+			done <- err
+		}()
+		command, _ := proto.Marshal(filemeta)
+		go func(follower int) {
+			_, err := raft.NewRaftClient(test.Conns[follower]).AppendEntries(test.Context, &raft.AppendEntryInput{
+				Term:         0,
+				PrevLogIndex: -1,
+				Entries:      []*raft.LogEntry{{Term: 0, Type: raft.EntryType_COMMAND, Command: command}},
+				LeaderCommit: -1,
+			})
+			done <- err
+		}(1 + i%2)
+		go func() {
+			_, err := test.Clients[0].GetFileInfoMap(test.Context, &emptypb.Empty{})
+			done <- err
+		}()
+		go func(idx int) {
+			_, err := test.Clients[idx].GetInternalState(test.Context, &emptypb.Empty{})
+			done <- err
+		}(i % len(test.Clients))
+	}
+	for i := 0; i < 4*updates; i++ {
+		if err := <-done; err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+	}
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	leaderState, _ := test.Clients[0].GetInternalState(test.Context, &emptypb.Empty{})
+	if len(leaderState.Log) != updates {
+		t.Fatalf("Leader should hold %d entries, has %d", updates, len(leaderState.Log))
+	}
+	for idx, server := range test.Clients {
+		state, err := server.GetInternalState(test.Context, &emptypb.Empty{})
+		if err != nil {
+			t.Fatalf("Server %d stopped responding: %v", idx, err)
+		}
+		if !SameLog(leaderState.Log, state.Log) {
+			t.Fatalf("Log of server %d differs from the leader's", idx)
+		}
+	}
+}
+
+func TestRaftPendingUpdateFailsWhenLeaderStepsDown(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitTest(cfgPath, "8080")
+	defer EndTest(test)
+
+	// TEST
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	// a committed update returns the version the MetaStore assigned, a
+	// conflicting one the MetaStore's error
+	filemeta := &surfstore.FileMetaData{Filename: "testFile1", Version: 1}
+	version, err := test.Clients[0].UpdateFile(test.Context, filemeta)
+	if err != nil || version.Version != 1 {
+		t.Fatalf("Update should have committed as version 1, got %v, %v", version, err)
+	}
+	if _, err := test.Clients[0].UpdateFile(test.Context, filemeta); err == nil {
+		t.Fatalf("Update with a stale version should fail")
+	}
+
+	// without a majority the next update can't commit
+	test.Clients[1].Crash(test.Context, &emptypb.Empty{})
+	test.Clients[2].Crash(test.Context, &emptypb.Empty{})
+	errs := make(chan error, 1)
+	go func() {
+		filemeta := &surfstore.FileMetaData{Filename: "testFile2", Version: 1}
+		_, err := test.Clients[0].UpdateFile(test.Context, filemeta)
+		errs <- err
+	}()
+	time.Sleep(500 * time.Millisecond)
+	select {
+	case err := <-errs:
+		t.Fatalf("Update should still be waiting to commit, returned %v", err)
+	default:
+	}
+
+	// once server 1 takes over, the waiting update is told to go elsewhere
+	test.Clients[1].Restore(test.Context, &emptypb.Empty{})
+	test.Clients[1].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[1].SendHeartbeat(test.Context, &emptypb.Empty{})
+	select {
+	case err := <-errs:
+		if _, notLeader := surfstore.LeaderAddrFromError(err); !notLeader {
+			t.Fatalf("Update should have failed with NotLeader, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Update was not failed after the leader stepped down")
+	}
+
+	state, _ := test.Clients[1].GetInternalState(test.Context, &emptypb.Empty{})
+	if _, ok := state.MetaMap.FileInfoMap["testFile2"]; ok {
+		t.Fatalf("Uncommitted update should not have been applied")
+	}
+}
+
+func TestRaftUpdateBlocksUntilMajorityRecovers(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitTest(cfgPath, "8080")
+	defer EndTest(test)
+
+	// TEST
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	test.Clients[1].Crash(test.Context, &emptypb.Empty{})
+	test.Clients[2].Crash(test.Context, &emptypb.Empty{})
+
+	// the caller's deadline ends the wait
+	filemeta := &surfstore.FileMetaData{Filename: "testFile1", Version: 1}
+	ctx, cancel := context.WithTimeout(test.Context, 300*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := test.Clients[0].UpdateFile(ctx, filemeta)
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("Update should have failed with DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Update returned %v after its deadline", elapsed)
+	}
+
+	// without one it commits as soon as a majority is back
+	type updateResult struct {
+		version *surfstore.Version
+		err     error
+	}
+	results := make(chan updateResult, 1)
+	go func() {
+		filemeta := &surfstore.FileMetaData{Filename: "testFile2", Version: 1}
+		version, err := test.Clients[0].UpdateFile(test.Context, filemeta)
+		results <- updateResult{version, err}
+	}()
+	time.Sleep(500 * time.Millisecond)
+	select {
+	case result := <-results:
+		t.Fatalf("Update should block without a majority, returned %v, %v", result.version, result.err)
+	default:
+	}
+
+	test.Clients[1].Restore(test.Context, &emptypb.Empty{})
+	select {
+	case result := <-results:
+		if result.err != nil || result.version.Version != 1 {
+			t.Fatalf("Update should have committed as version 1, got %v, %v", result.version, result.err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Update did not commit after server 1 was restored")
+	}
+}
+
+func TestRaftRetriedUpdateAppliedOnce(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitTest(cfgPath, "8080")
+	defer EndTest(test)
+
+	// TEST
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	update := func(server int, filename string, version int32, sequenceNum int64) (*surfstore.Version, error) {
+		filemeta := &surfstore.FileMetaData{
+			Filename:    filename,
+			Version:     version,
+			ClientId:    "client1",
+			SequenceNum: sequenceNum,
+		}
+		return test.Clients[server].UpdateFile(test.Context, filemeta)
+	}
+
+	if version, err := update(0, "testFile1", 1, 1); err != nil || version.Version != 1 {
+		t.Fatalf("Update should have committed as version 1, got %v, %v", version, err)
+	}
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	// the client retries after its first attempt timed out, and the retry
+	// lands on a new leader
+	test.Clients[1].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[1].SendHeartbeat(test.Context, &emptypb.Empty{})
+	if version, err := update(1, "testFile1", 1, 1); err != nil || version.Version != 1 {
+		t.Fatalf("Retry should return the original version 1, got %v, %v", version, err)
+	}
+
+	// a new request from the same client is applied as usual, an older
+	// one is not applied again
+	if version, err := update(1, "testFile1", 2, 2); err != nil || version.Version != 2 {
+		t.Fatalf("Update should have committed as version 2, got %v, %v", version, err)
+	}
+	if _, err := update(1, "testFile1", 1, 1); err == nil {
+		t.Fatalf("Update older than the client's last one should fail")
+	}
+	test.Clients[1].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	goldenMeta := surfstore.NewMetaStore("")
+	goldenMeta.UpdateFile(test.Context, &surfstore.FileMetaData{Filename: "testFile1", Version: 1})
+	goldenMeta.UpdateFile(test.Context, &surfstore.FileMetaData{Filename: "testFile1", Version: 2})
+	for idx, server := range test.Clients {
+		state, _ := server.GetInternalState(test.Context, &emptypb.Empty{})
+		if !SameMeta(goldenMeta.FileMetaMap, state.MetaMap.FileInfoMap) {
+			t.Fatalf("MetaStore state of server %d is not correct", idx)
+		}
+	}
+}
+
+func TestRaftIsolatedLeaderReplacedAndHealed(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitElectionTest(cfgPath, "8080")
+	defer EndTest(test)
+
+	// TEST
+	oldLeader := WaitForLeader(test, 5*time.Second)
+	if oldLeader == -1 {
+		t.Fatalf("No leader was elected")
+	}
+	state, _ := test.Clients[oldLeader].GetInternalState(test.Context, &emptypb.Empty{})
+	oldTerm := state.Term
+
+	// the isolated leader can't commit, the others elect a new one
+	IsolateServer(test, oldLeader)
+	ctx, cancel := context.WithTimeout(test.Context, 500*time.Millisecond)
+	defer cancel()
+	stale := &surfstore.FileMetaData{Filename: "testFile1", Version: 1}
+	if _, err := test.Clients[oldLeader].UpdateFile(ctx, stale); err == nil {
+		t.Fatalf("Isolated leader should not commit updates")
+	}
+
+	time.Sleep(2 * time.Second)
+	newLeader := -1
+	for idx, server := range test.Clients {
+		state, _ := server.GetInternalState(test.Context, &emptypb.Empty{})
+		if idx != oldLeader && state.IsLeader && state.Term > oldTerm {
+			newLeader = idx
+		}
+	}
+	if newLeader == -1 {
+		t.Fatalf("The majority side did not elect a new leader")
+	}
+	filemeta := &surfstore.FileMetaData{Filename: "testFile2", Version: 1}
+	if _, err := test.Clients[newLeader].UpdateFile(test.Context, filemeta); err != nil {
+		t.Fatalf("Update on the new leader failed: %v", err)
+	}
+
+	// once healed, the old leader steps down and drops its stale entry
+	HealNetwork(test)
+	time.Sleep(time.Second)
+	leaderState, _ := test.Clients[newLeader].GetInternalState(test.Context, &emptypb.Empty{})
+	for idx, server := range test.Clients {
+		state, _ := server.GetInternalState(test.Context, &emptypb.Empty{})
+		if idx != newLeader && state.IsLeader {
+			t.Fatalf("Server %d should have stepped down", idx)
+		}
+		if !SameLog(leaderState.Log, state.Log) {
+			t.Fatalf("Log of server %d differs from the leader's", idx)
+		}
+		if _, ok := state.MetaMap.FileInfoMap["testFile1"]; ok {
+			t.Fatalf("Server %d applied the isolated leader's update", idx)
+		}
+	}
+}
+
+func TestRaftReorderedAppendsKeepLogsConsistent(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitTest(cfgPath, "8080")
+	defer EndTest(test)
+
+	// TEST
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	// pipelined AppendEntries arrive at the followers out of order
+	DelayTraffic(test, 0, 1, 0, 50*time.Millisecond)
+	DelayTraffic(test, 0, 2, 0, 50*time.Millisecond)
+
+	const updates = 50
+	goldenMeta := surfstore.NewMetaStore("")
+	errs := make(chan error, updates)
+	for i := 0; i < updates; i++ {
+		filemeta := &surfstore.FileMetaData{Filename: "testFile" + strconv.Itoa(i), Version: 1}
+		goldenMeta.UpdateFile(test.Context, filemeta)
+		go func() {
+			_, err := test.Clients[0].UpdateFile(test.Context, filemeta)
+			errs <- err
+		}()
+		time.Sleep(5 * time.Millisecond)
+	}
+	for i := 0; i < updates; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("Update failed: %v", err)
+		}
+	}
+
+	HealNetwork(test)
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	leaderState, _ := test.Clients[0].GetInternalState(test.Context, &emptypb.Empty{})
+	for idx, server := range test.Clients {
+		state, _ := server.GetInternalState(test.Context, &emptypb.Empty{})
+		if !SameLog(leaderState.Log, state.Log) {
+			t.Fatalf("Log of server %d differs from the leader's", idx)
+		}
+		if !SameMeta(goldenMeta.FileMetaMap, state.MetaMap.FileInfoMap) {
+			t.Fatalf("MetaStore state of server %d is not correct", idx)
+		}
+	}
+}
+
+func TestRaftClusterStatus(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitTest(cfgPath, "8080")
+	defer EndTest(test)
+
+	// TEST
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+	for i := 1; i <= 2; i++ {
+		filemeta := &surfstore.FileMetaData{Filename: "testFile" + strconv.Itoa(i), Version: 1}
+		test.Clients[0].UpdateFile(test.Context, filemeta)
+	}
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	// server 2 falls behind
+	test.Clients[2].Crash(test.Context, &emptypb.Empty{})
+	filemeta := &surfstore.FileMetaData{Filename: "testFile3", Version: 1}
+	test.Clients[0].UpdateFile(test.Context, filemeta)
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	leaderStatus, err := test.Clients[0].GetClusterStatus(test.Context, &emptypb.Empty{})
+	if err != nil {
+		t.Fatalf("Leader status failed: %v", err)
+	}
+	if leaderStatus.Role != raft.Role_LEADER || leaderStatus.CommitIndex != 2 || leaderStatus.LastLogIndex != 2 {
+		t.Fatalf("Unexpected leader status %v", leaderStatus)
+	}
+	matchIndex := map[int64]int64{}
+	for _, peer := range leaderStatus.Peers {
+		matchIndex[peer.ServerId] = peer.MatchIndex
+	}
+	if len(matchIndex) != 2 || matchIndex[1] != 2 || matchIndex[2] != 1 {
+		t.Fatalf("Leader should see server 1 at index 2 and server 2 at index 1, got %v", matchIndex)
+	}
+
+	followerStatus, err := test.Clients[1].GetClusterStatus(test.Context, &emptypb.Empty{})
+	if err != nil {
+		t.Fatalf("Follower status failed: %v", err)
+	}
+	if followerStatus.Role != raft.Role_FOLLOWER || followerStatus.LeaderId != 0 ||
+		followerStatus.Term != leaderStatus.Term || len(followerStatus.Peers) != 0 {
+		t.Fatalf("Unexpected follower status %v", followerStatus)
+	}
+
+	// a crashed server is unreachable
+	if _, err := test.Clients[2].GetClusterStatus(test.Context, &emptypb.Empty{}); status.Code(err) != codes.Unavailable {
+		t.Fatalf("Expected Unavailable from a crashed server, got %v", err)
+	}
+}
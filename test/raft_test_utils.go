@@ -4,10 +4,13 @@ import (
 	context "context"
 	"cse224/proj5/pkg/surfstore"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
 	"log"
 	"os"
 	"os/exec"
 	"strconv"
+	"syscall"
 	"time"
 )
 
@@ -19,19 +22,36 @@ type TestInfo struct {
 	Procs      []*exec.Cmd
 	Conns      []*grpc.ClientConn
 	Clients    []surfstore.RaftSurfstoreClient
+	ServerArgs []string
 }
 
+// Starts servers with elections disabled, tests choose the leader with SetLeader
 func InitTest(cfgPath, blockStorePort string) TestInfo {
+	return InitTestWithArgs(cfgPath, blockStorePort, "-manual")
+}
+
+// Starts servers that elect a leader on their own
+func InitElectionTest(cfgPath, blockStorePort string) TestInfo {
+	return InitTestWithArgs(cfgPath, blockStorePort)
+}
+
+// Starts servers with elections disabled that keep their state in dataDir
+func InitDurableTest(cfgPath, blockStorePort, dataDir string) TestInfo {
+	return InitTestWithArgs(cfgPath, blockStorePort, "-manual", "-data-dir", dataDir)
+}
+
+// Starts servers with extra command line flags
+func InitTestWithArgs(cfgPath, blockStorePort string, serverArgs ...string) TestInfo {
 	cfg := surfstore.LoadRaftConfigFile(cfgPath)
 
 	procs := make([]*exec.Cmd, 0)
 	procs = append(procs, InitBlockStore(blockStorePort))
-	procs = append(procs, InitRaftServers(cfgPath)...)
+	procs = append(procs, InitRaftServers(cfgPath, serverArgs...)...)
 
 	conns := make([]*grpc.ClientConn, 0)
 	clients := make([]surfstore.RaftSurfstoreClient, 0)
 	for _, addr := range cfg {
-		conn, err := grpc.Dial(addr, grpc.WithInsecure())
+		conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
 		if err != nil {
 			log.Fatal("Error connecting to clients ", err)
 		}
@@ -51,6 +71,7 @@ func InitTest(cfgPath, blockStorePort string) TestInfo {
 		Procs:      procs,
 		Conns:      conns,
 		Clients:    clients,
+		ServerArgs: serverArgs,
 	}
 }
 
@@ -70,6 +91,154 @@ func EndTest(test TestInfo) {
 	time.Sleep(100 * time.Millisecond)
 }
 
+// Kills server idx and starts it again with the same arguments, returning
+// once it accepts requests
+func RestartRaftServer(test TestInfo, idx int) {
+	proc := test.Procs[idx+1]
+	_ = proc.Process.Kill()
+	_ = proc.Wait()
+
+	test.Procs[idx+1] = startRaftServer(test.CfgPath, idx, test.ServerArgs...)
+
+	test.Conns[idx].Close()
+	conn, err := grpc.Dial(test.Ips[idx], grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		log.Fatal("Error connecting to clients ", err)
+	}
+	test.Conns[idx] = conn
+	test.Clients[idx] = surfstore.NewRaftSurfstoreClient(conn)
+
+	for i := 0; i < 50; i++ {
+		ctx, cancel := context.WithTimeout(test.Context, 100*time.Millisecond)
+		_, err := test.Clients[idx].IsCrashed(ctx, &emptypb.Empty{}, grpc.WaitForReady(true))
+		cancel()
+		if err == nil {
+			return
+		}
+	}
+	log.Fatal("Server ", idx, " did not come back up")
+}
+
+// Starts the servers in cfgPath beyond the ones test already runs, outside
+// the cluster so they can be added with AddServer
+func JoinRaftServers(test TestInfo, cfgPath string) TestInfo {
+	cfg := surfstore.LoadRaftConfigFile(cfgPath)
+	serverArgs := append(append([]string{}, test.ServerArgs...), "-join")
+	for idx := len(test.Ips); idx < len(cfg); idx++ {
+		test.Procs = append(test.Procs, startRaftServer(cfgPath, idx, serverArgs...))
+
+		conn, err := grpc.Dial(cfg[idx], grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			log.Fatal("Error connecting to clients ", err)
+		}
+		test.Ips = append(test.Ips, cfg[idx])
+		test.Conns = append(test.Conns, conn)
+		test.Clients = append(test.Clients, surfstore.NewRaftSurfstoreClient(conn))
+
+		ctx, cancel := context.WithTimeout(test.Context, 5*time.Second)
+		_, err = test.Clients[idx].IsCrashed(ctx, &emptypb.Empty{}, grpc.WaitForReady(true))
+		cancel()
+		if err != nil {
+			log.Fatal("Server ", idx, " did not come up")
+		}
+	}
+	return test
+}
+
+// Runs the admin command with args, e.g. "add", "-f", cfgPath, "-i", "3"
+func RunAdmin(args ...string) error {
+	adminCmd := exec.Command("_bin/SurfstoreAdminExec", args...)
+	adminCmd.Stderr = os.Stderr
+	adminCmd.Stdout = os.Stdout
+
+	return adminCmd.Run()
+}
+
+// Stops the process of server idx without killing it. Unlike Crash, the
+// server's timers keep running, so once resumed it acts like a server
+// coming back from a network partition.
+func PauseRaftServer(test TestInfo, idx int) {
+	if err := test.Procs[idx+1].Process.Signal(syscall.SIGSTOP); err != nil {
+		log.Fatal("Error pausing server ", idx, ": ", err)
+	}
+}
+
+func ResumeRaftServer(test TestInfo, idx int) {
+	if err := test.Procs[idx+1].Process.Signal(syscall.SIGCONT); err != nil {
+		log.Fatal("Error resuming server ", idx, ": ", err)
+	}
+}
+
+// Drops every RPC server from sends to server to, replies included. Traffic
+// the other way is untouched, so on its own this is an asymmetric partition.
+func BlockTraffic(test TestInfo, from, to int) {
+	setNetworkFault(test, from, &surfstore.NetworkFault{Addr: test.Ips[to], DropRate: 1})
+}
+
+// Holds back every RPC server from sends to server to by delay plus a random
+// part of jitter. A jitter longer than the gap between requests reorders them.
+func DelayTraffic(test TestInfo, from, to int, delay, jitter time.Duration) {
+	setNetworkFault(test, from, &surfstore.NetworkFault{
+		Addr:     test.Ips[to],
+		DelayMs:  delay.Milliseconds(),
+		JitterMs: jitter.Milliseconds(),
+	})
+}
+
+// Splits the servers into groups that only reach servers in their own
+// group. Servers left out of every group are not affected.
+func PartitionServers(test TestInfo, groups ...[]int) {
+	for i, group := range groups {
+		for j, other := range groups {
+			if i == j {
+				continue
+			}
+			for _, from := range group {
+				for _, to := range other {
+					BlockTraffic(test, from, to)
+				}
+			}
+		}
+	}
+}
+
+// Cuts server idx off from every other server in both directions
+func IsolateServer(test TestInfo, idx int) {
+	others := make([]int, 0, len(test.Clients)-1)
+	for other := range test.Clients {
+		if other != idx {
+			others = append(others, other)
+		}
+	}
+	PartitionServers(test, []int{idx}, others)
+}
+
+// Removes the faults from every server
+func HealNetwork(test TestInfo) {
+	for idx, server := range test.Clients {
+		if _, err := server.ClearNetworkFaults(test.Context, &emptypb.Empty{}); err != nil {
+			log.Fatal("Error healing the network of server ", idx, ": ", err)
+		}
+	}
+}
+
+func setNetworkFault(test TestInfo, idx int, fault *surfstore.NetworkFault) {
+	if _, err := test.Clients[idx].SetNetworkFault(test.Context, fault); err != nil {
+		log.Fatal("Error injecting a fault on server ", idx, ": ", err)
+	}
+}
+
+func startRaftServer(cfgPath string, idx int, serverArgs ...string) *exec.Cmd {
+	args := append([]string{"-f", cfgPath, "-i", strconv.Itoa(idx), "-b", "localhost:8080"}, serverArgs...)
+	cmd := exec.Command("_bin/SurfstoreRaftServerExec", args...)
+	cmd.Stderr = os.Stderr
+	cmd.Stdout = os.Stdout
+	if err := cmd.Start(); err != nil {
+		log.Fatal("Error starting servers", err)
+	}
+	return cmd
+}
+
 func InitBlockStore(blockStorePort string) *exec.Cmd {
 	blockCmd := exec.Command("_bin/SurfstoreServerExec", "-s", "block", "-p", blockStorePort, "-l")
 	blockCmd.Stderr = os.Stderr
@@ -82,21 +251,11 @@ func InitBlockStore(blockStorePort string) *exec.Cmd {
 	return blockCmd
 }
 
-func InitRaftServers(cfgPath string) []*exec.Cmd {
+func InitRaftServers(cfgPath string, serverArgs ...string) []*exec.Cmd {
 	cfg := surfstore.LoadRaftConfigFile(cfgPath)
 	cmdList := make([]*exec.Cmd, 0)
 	for idx, _ := range cfg {
-		cmd := exec.Command("_bin/SurfstoreRaftServerExec", "-f", cfgPath, "-i", strconv.Itoa(idx), "-b", "localhost:8080")
-		cmd.Stderr = os.Stderr
-		cmd.Stdout = os.Stdout
-		cmdList = append(cmdList, cmd)
-	}
-
-	for _, cmd := range cmdList {
-		err := cmd.Start()
-		if err != nil {
-			log.Fatal("Error starting servers", err)
-		}
+		cmdList = append(cmdList, startRaftServer(cfgPath, idx, serverArgs...))
 	}
 
 	time.Sleep(2 * time.Second)
@@ -104,6 +263,26 @@ func InitRaftServers(cfgPath string) []*exec.Cmd {
 	return cmdList
 }
 
+// Polls every server that isn't crashed until one of them reports being the
+// leader, returning its index or -1 if none is found before the timeout
+func WaitForLeader(test TestInfo, timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		for idx, server := range test.Clients {
+			crashed, err := server.IsCrashed(test.Context, &emptypb.Empty{})
+			if err != nil || crashed.IsCrashed {
+				continue
+			}
+			state, err := server.GetInternalState(test.Context, &emptypb.Empty{})
+			if err == nil && state.IsLeader {
+				return idx
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return -1
+}
+
 func SameOperation(op1, op2 *surfstore.UpdateOperation) bool {
 	if op1 == nil && op2 == nil {
 		return true
@@ -118,6 +297,13 @@ func SameOperation(op1, op2 *surfstore.UpdateOperation) bool {
 		op1.FileMetaData != nil && op2.FileMetaData == nil {
 		return false
 	}
+	if (op1.Configuration == nil) != (op2.Configuration == nil) {
+		return false
+	}
+	if op1.FileMetaData == nil {
+		// both are no-ops or configuration changes
+		return true
+	}
 	if op1.FileMetaData.Version != op2.FileMetaData.Version {
 		return false
 	}
@@ -0,0 +1,111 @@
+package SurfTest
+
+import (
+	context "context"
+	"cse224/proj5/pkg/raft"
+	"cse224/proj5/pkg/surfstore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Servers in this process on the real clock, connected over an InmemNetwork
+func startInmemCluster(size int) []*surfstore.RaftSurfstore {
+	ips := make([]string, size)
+	for idx := range ips {
+		ips[idx] = "inmem" + strconv.Itoa(idx)
+	}
+	network := raft.NewInmemNetwork()
+	servers := make([]*surfstore.RaftSurfstore, size)
+	for idx, ip := range ips {
+		server, err := surfstore.NewRaftServer(int64(idx), ips, "", surfstore.RaftServerOptions{
+			Transport: network.Transport(ip),
+		})
+		if err != nil {
+			panic(err)
+		}
+		network.Register(ip, server.Raft())
+		servers[idx] = server
+	}
+	for _, server := range servers {
+		surfstore.StartRaftServer(server)
+	}
+	return servers
+}
+
+func stopInmemCluster(servers []*surfstore.RaftSurfstore) {
+	for _, server := range servers {
+		surfstore.StopRaftServer(server)
+	}
+}
+
+func waitForInmemLeader(servers []*surfstore.RaftSurfstore, timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		for idx, server := range servers {
+			state, _ := server.GetInternalState(context.Background(), &emptypb.Empty{})
+			if state.IsLeader {
+				return idx
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return -1
+}
+
+func TestRaftInmemTransportReplicates(t *testing.T) {
+	//Setup
+	servers := startInmemCluster(3)
+	defer stopInmemCluster(servers)
+
+	// TEST
+	leader := waitForInmemLeader(servers, 5*time.Second)
+	if leader == -1 {
+		t.Fatalf("No leader was elected")
+	}
+	filemeta := &surfstore.FileMetaData{Filename: "testFile1", Version: 1}
+	if _, err := servers[leader].UpdateFile(context.Background(), filemeta); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+
+	time.Sleep(2 * raft.HEARTBEAT_INTERVAL)
+	leaderState, _ := servers[leader].GetInternalState(context.Background(), &emptypb.Empty{})
+	for idx, server := range servers {
+		state, _ := server.GetInternalState(context.Background(), &emptypb.Empty{})
+		if !SameLog(leaderState.Log, state.Log) {
+			t.Fatalf("Log of server %d differs from the leader's", idx)
+		}
+		if !SameMeta(leaderState.MetaMap.FileInfoMap, state.MetaMap.FileInfoMap) {
+			t.Fatalf("MetaStore of server %d differs from the leader's", idx)
+		}
+	}
+
+	// a server nobody registered can't be reached
+	transport := raft.NewInmemNetwork().Transport("inmem0")
+	_, err := transport.RequestVote(context.Background(), "inmem1", &raft.RequestVoteInput{})
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("Expected Unavailable for an unknown server, got %v", err)
+	}
+}
+
+// Measures how fast the consensus core commits updates one after another,
+// without any networking
+func BenchmarkRaftUpdateFileInmem(b *testing.B) {
+	servers := startInmemCluster(3)
+	defer stopInmemCluster(servers)
+	leader := waitForInmemLeader(servers, 5*time.Second)
+	if leader == -1 {
+		b.Fatalf("No leader was elected")
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		filemeta := &surfstore.FileMetaData{Filename: "testFile" + strconv.Itoa(i), Version: 1}
+		if _, err := servers[leader].UpdateFile(context.Background(), filemeta); err != nil {
+			b.Fatalf("Update failed: %v", err)
+		}
+	}
+}